@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/codefly-dev/core/wool"
+)
+
+// defaultAdminTimeout bounds an admin statement without admin-timeout
+const defaultAdminTimeout = 30 * time.Second
+
+// maxAdminRows returned by an admin query: the rest is dropped and the result marked truncated
+const maxAdminRows = 1000
+
+// AdminResult of a statement: the rows of a query, the affected rows of anything else
+type AdminResult struct {
+	Columns      []string `json:"columns,omitempty"`
+	Rows         [][]any  `json:"rows,omitempty"`
+	Truncated    bool     `json:"truncated,omitempty"`
+	RowsAffected int64    `json:"rows_affected"`
+}
+
+// Comments and string literals are removed before looking for keywords: a dropped word in a literal isn't a DROP
+var (
+	sqlLiteral      = regexp.MustCompile(`(?s)'(?:[^']|'')*'|--[^\n]*|/\*.*?\*/`)
+	sqlDestructive  = regexp.MustCompile(`(?i)\b(drop|truncate|delete|update|alter|revoke)\b`)
+	sqlReturnsRows  = regexp.MustCompile(`(?i)^\s*(select|with|show|values|table|explain)\b|\breturning\b`)
+	sqlFirstKeyword = regexp.MustCompile(`^\s*([A-Za-z]+)`)
+)
+
+// destructiveStatement is the first keyword of the statement that changes or drops data, empty when there is none:
+// a keyword anywhere counts, so an ON DELETE clause needs the confirmation too
+func destructiveStatement(statement string) string {
+	return strings.ToUpper(sqlDestructive.FindString(sqlLiteral.ReplaceAllString(statement, "''")))
+}
+
+// statementKeyword is logged in place of the statement, which may contain a password
+func statementKeyword(statement string) string {
+	match := sqlFirstKeyword.FindStringSubmatch(sqlLiteral.ReplaceAllString(statement, ""))
+	if match == nil {
+		return ""
+	}
+	return strings.ToUpper(match[1])
+}
+
+// Admin runs a one-off statement, like VACUUM or a GRANT, with the runtime pool and the admin-timeout:
+// a statement dropping or changing data needs confirm
+func (s *Runtime) Admin(ctx context.Context, statement string, confirm bool) (*AdminResult, error) {
+	if strings.TrimSpace(statement) == "" {
+		return nil, s.Wool.NewError("empty admin statement")
+	}
+	keyword := statementKeyword(statement)
+	w := s.Wool.With(wool.Field("statement", keyword))
+	if destructive := destructiveStatement(statement); destructive != "" {
+		if !confirm {
+			return nil, w.NewError("%s changes or drops data: confirm to run it", destructive)
+		}
+		w.Warn(destructive + " confirmed on " + s.DatabaseName)
+	}
+	// The statement may contain a password: only the keyword is logged above debug
+	w.Debug("running admin statement", wool.Field("sql", statement))
+
+	timeout := s.Settings.AdminTimeout
+	if timeout <= 0 {
+		timeout = defaultAdminTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	db, err := s.database()
+	if err != nil {
+		return nil, err
+	}
+	if !sqlReturnsRows.MatchString(sqlLiteral.ReplaceAllString(statement, "''")) {
+		res, err := db.ExecContext(ctx, statement)
+		if err != nil {
+			return nil, w.Wrapf(err, "cannot run admin statement")
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return nil, w.Wrapf(err, "cannot read affected rows")
+		}
+		w.Info("admin statement done", wool.Field("rows_affected", affected))
+		return &AdminResult{RowsAffected: affected}, nil
+	}
+
+	rows, err := db.QueryContext(ctx, statement)
+	if err != nil {
+		return nil, w.Wrapf(err, "cannot run admin query")
+	}
+	defer rows.Close()
+	result := &AdminResult{}
+	result.Columns, err = rows.Columns()
+	if err != nil {
+		return nil, w.Wrapf(err, "cannot read columns")
+	}
+	for rows.Next() {
+		if len(result.Rows) == maxAdminRows {
+			result.Truncated = true
+			break
+		}
+		values := make([]any, len(result.Columns))
+		pointers := make([]any, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, w.Wrapf(err, "cannot read row")
+		}
+		// Text and numeric columns come as bytes
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, w.Wrapf(err, "cannot read rows")
+	}
+	result.RowsAffected = int64(len(result.Rows))
+	w.Info("admin query done", wool.Field("rows", len(result.Rows)))
+	return result, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	goruntime "runtime"
+	"time"
+
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// backupMountDir is where the destination directory is mounted in the pg_dump container
+const backupMountDir = "/backup"
+
+// Backup dumps the database with pg_dump in a container:
+// a .sql destination gets a plain dump, anything else a custom-format one
+func (s *Runtime) Backup(ctx context.Context, destPath string) error {
+	dest, err := filepath.Abs(destPath)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot resolve backup destination")
+	}
+	dir := filepath.Dir(dest)
+	if err = checkWritable(dir); err != nil {
+		return s.Wool.Wrapf(err, "backup destination is not writable: %s", dir)
+	}
+
+	connection, err := s.containerConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	format := "custom"
+	if filepath.Ext(dest) == ".sql" {
+		format = "plain"
+	}
+	// Write the dump as the current user rather than root
+	var user string
+	if goruntime.GOOS == "linux" {
+		user = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	}
+
+	s.Wool.Debug("backing up database", wool.FileField(dest))
+	err = oneshot.Run(ctx, &oneshot.Container{
+		Name:  fmt.Sprintf("%s-backup", s.UniqueWithWorkspace()),
+		Image: s.image(),
+		Cmd:   []string{"pg_dump", "--dbname", connection, "--format", format, "--file", path.Join(backupMountDir, filepath.Base(dest))},
+		User:  user,
+		Mounts: []mount.Mount{
+			{Type: mount.TypeBind, Source: dir, Target: backupMountDir},
+		},
+	})
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot back up database")
+	}
+	return nil
+}
+
+// backupBeforeMigration dumps the database in the backups folder of the service
+func (s *Runtime) backupBeforeMigration(ctx context.Context) error {
+	dir := s.Local("backups")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return s.Wool.Wrapf(err, "cannot create backup directory")
+	}
+	dest := path.Join(dir, fmt.Sprintf("%s-%s.dump", s.DatabaseName, time.Now().Format("20060102-150405")))
+	return s.Backup(ctx, dest)
+}
+
+// checkWritable creates and removes a file in the directory
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".codefly-backup-*")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
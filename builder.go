@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"embed"
+	"encoding/base64"
 	"fmt"
 	dockerhelpers "github.com/codefly-dev/core/agents/helpers/docker"
 	v0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
 	"github.com/codefly-dev/core/resources"
 	"github.com/codefly-dev/core/standards"
 	"github.com/codefly-dev/core/wool"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/codefly-dev/core/agents/communicate"
 	agentv0 "github.com/codefly-dev/core/generated/go/codefly/services/agent/v0"
@@ -17,12 +22,17 @@ import (
 	builderv0 "github.com/codefly-dev/core/generated/go/codefly/services/builder/v0"
 	"github.com/codefly-dev/core/shared"
 	"github.com/codefly-dev/core/templates"
+	"github.com/codefly-dev/service-external-postgres/migrations"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
 )
 
 type Builder struct {
 	*Service
 }
 
+// verifyConnectionTimeout bounds the connection check of a deployment
+const verifyConnectionTimeout = 5 * time.Second
+
 func NewBuilder() *Builder {
 	return &Builder{
 		Service: NewService(),
@@ -63,6 +73,12 @@ func (s *Builder) Load(ctx context.Context, req *builderv0.LoadRequest) (*builde
 		return s.Builder.LoadResponse()
 	}
 
+	// Create chooses the settings
+	err = s.Settings.Validate()
+	if err != nil {
+		return s.Builder.LoadError(err)
+	}
+
 	s.Endpoints, err = s.Builder.Service.LoadEndpoints(ctx)
 	if err != nil {
 		return s.Builder.LoadError(err)
@@ -99,6 +115,13 @@ func (s *Builder) Sync(ctx context.Context, req *builderv0.SyncRequest) (*builde
 
 type DockerTemplating struct {
 	ConnectionStringKeyHolder string
+
+	// Format picks the tool and the command of the migration image
+	Format string
+	// Image of the dbmate and flyway tools
+	Image string
+	// MigrationsTable when it isn't the default of the tool
+	MigrationsTable string
 }
 
 func (s *Builder) WithMigration() bool {
@@ -110,7 +133,9 @@ func (s *Builder) Build(ctx context.Context, req *builderv0.BuildRequest) (*buil
 
 	if !s.WithMigration() {
 		s.Wool.Debug("build: no migration")
-		return nil, nil
+		// The runtime image is still reported for audit
+		s.Builder.WithDockerImages(s.runtimeImage())
+		return s.Builder.BuildResponse()
 	}
 
 	s.Wool.Debug("building migration docker image")
@@ -128,15 +153,7 @@ func (s *Builder) Build(ctx context.Context, req *builderv0.BuildRequest) (*buil
 		return s.Builder.BuildError(fmt.Errorf("invalid docker image name: %s", img.Name))
 	}
 
-	connectionKey := resources.ServiceSecretConfigurationKey(s.Base.Identity, "postgres", "connection")
-	docker := DockerTemplating{ConnectionStringKeyHolder: fmt.Sprintf("{%s}", connectionKey)}
-
-	err = shared.DeleteFile(ctx, s.Local("builder/Dockerfile"))
-	if err != nil {
-		return s.Builder.BuildError(err)
-	}
-
-	err = s.Templates(ctx, docker, services.WithBuilder(builderFS))
+	err = s.writeDockerfile(ctx)
 	if err != nil {
 		return s.Builder.BuildError(err)
 	}
@@ -155,11 +172,77 @@ func (s *Builder) Build(ctx context.Context, req *builderv0.BuildRequest) (*buil
 		return s.Builder.BuildError(err)
 	}
 
-	s.Builder.WithDockerImages(img)
+	// The migration image, then the postgres image the service runs on
+	s.Builder.WithDockerImages(img, s.runtimeImage())
 
 	return s.Builder.BuildResponse()
 }
 
+// migrationFormat of the migration job: alembic projects have none
+func (s *Builder) migrationFormat() (string, error) {
+	format := s.Settings.MigrationFormat
+	if format == migrations.AutoFormat {
+		detected, err := migrations.DetectFormat(s.Local("migrations"))
+		if err != nil {
+			return "", s.Wool.Wrapf(err, "cannot detect migration format")
+		}
+		if detected == "" {
+			return "", s.Wool.NewError("cannot detect migration format: set migration-format")
+		}
+		format = detected
+	}
+	switch format {
+	case "":
+		return migrations.GolangMigrateFormat, nil
+	case migrations.GolangMigrateFormat, migrations.DbmateFormat, migrations.FlywayFormat:
+		return format, nil
+	}
+	return "", s.Wool.NewError("no migration job for the %s format", format)
+}
+
+// writeDockerfile of the migration image: the tool and its command depend on the migration format
+func (s *Builder) writeDockerfile(ctx context.Context) error {
+	format, err := s.migrationFormat()
+	if err != nil {
+		return err
+	}
+	connectionKey := resources.ServiceSecretConfigurationKey(s.Base.Identity, "postgres", connectionKey)
+	docker := DockerTemplating{
+		ConnectionStringKeyHolder: fmt.Sprintf("{%s}", connectionKey),
+		Format:                    format,
+		MigrationsTable:           s.Settings.MigrationsTable,
+	}
+	switch format {
+	case migrations.DbmateFormat:
+		docker.Image = oneshot.WithRegistry(s.Settings.ImageRegistryPrefix, migrations.DbmateImage).FullName()
+	case migrations.FlywayFormat:
+		docker.Image = oneshot.WithRegistry(s.Settings.ImageRegistryPrefix, migrations.FlywayImage).FullName()
+	}
+
+	err = shared.DeleteFile(ctx, s.Local("builder/Dockerfile"))
+	if err != nil {
+		return err
+	}
+	return s.Templates(ctx, docker, services.WithBuilder(builderFS))
+}
+
+// flywaySecrets of the migration job: flyway doesn't read a postgresql:// connection string
+func (s *Builder) flywaySecrets(ctx context.Context, req *builderv0.DeploymentRequest, instance *v0.NetworkInstance, secrets services.EnvironmentMap) error {
+	connection, err := s.createConnectionString(ctx, req.Configuration, instance.Address, s.withSSL(req.Environment))
+	if err != nil {
+		return err
+	}
+	env, err := migrations.NewFlyway(ctx, &migrations.Config{}).JDBCEnvironment(connection)
+	if err != nil {
+		return err
+	}
+	for _, variable := range env {
+		key, value, _ := strings.Cut(variable, "=")
+		secrets[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return nil
+}
+
 func (s *Builder) Deploy(ctx context.Context, req *builderv0.DeploymentRequest) (*builderv0.DeploymentResponse, error) {
 	defer s.Wool.Catch()
 
@@ -167,16 +250,33 @@ func (s *Builder) Deploy(ctx context.Context, req *builderv0.DeploymentRequest)
 
 	s.EnvironmentVariables.SetRunning()
 
+	// The password may be missing with trust
+	err := s.checkHostAuthMethod(req.Environment)
+	if err != nil {
+		return s.Builder.DeployError(err)
+	}
+
 	instance, err := resources.FindNetworkInstanceInNetworkMappings(ctx, req.NetworkMappings, s.TcpEndpoint, resources.NewPublicNetworkAccess())
 	if err != nil {
 		return s.Builder.DeployError(err)
 	}
 
-	conf, err := s.CreateConnectionConfiguration(ctx, req.Configuration, instance, !s.Settings.WithoutSSL)
+	conf, err := s.CreateConnectionConfiguration(ctx, req.Configuration, instance, s.withSSL(req.Environment))
 	if err != nil {
 		return s.Builder.DeployError(err)
 	}
 
+	if s.Settings.VerifyConnectionOnDeploy {
+		// The plain connection string: the exported one may carry parameters for a pooler
+		connection, err := s.createConnectionString(ctx, req.Configuration, instance.Address, s.withSSL(req.Environment))
+		if err != nil {
+			return s.Builder.DeployError(err)
+		}
+		if err = s.verifyConnection(ctx, connection); err != nil {
+			return s.Builder.DeployError(err)
+		}
+	}
+
 	err = s.EnvironmentVariables.AddConfigurations(ctx, conf)
 	if err != nil {
 		return s.Builder.DeployError(err)
@@ -186,11 +286,16 @@ func (s *Builder) Deploy(ctx context.Context, req *builderv0.DeploymentRequest)
 
 	s.Wool.Debug("exporting configuration", wool.Field("conf", resources.MakeConfigurationSummary(conf)))
 
-	if !s.WithMigration() {
+	managed := s.Settings.DeployMode == ManagedDeployMode
+	if !s.WithMigration() && !managed {
 		s.Wool.Debug("deploy: no migration")
 		return s.Builder.DeployResponse()
 	}
 
+	if s.WithMigration() && s.Settings.ConnectionFormat == KeywordConnectionFormat {
+		return s.Builder.DeployError(s.Wool.NewError("the migration job needs a url connection format"))
+	}
+
 	cm, err := services.EnvsAsConfigMapData(s.EnvironmentVariables.Configurations()...)
 	if err != nil {
 		return s.Builder.DeployError(err)
@@ -201,9 +306,36 @@ func (s *Builder) Deploy(ctx context.Context, req *builderv0.DeploymentRequest)
 		return s.Builder.DeployError(err)
 	}
 
+	if s.WithMigration() {
+		format, err := s.migrationFormat()
+		if err != nil {
+			return s.Builder.DeployError(err)
+		}
+		if format == migrations.FlywayFormat {
+			if err = s.flywaySecrets(ctx, req, instance, secrets); err != nil {
+				return s.Builder.DeployError(err)
+			}
+		}
+	}
+
+	if _, err = s.containerResources(); err != nil {
+		return s.Builder.DeployError(err)
+	}
+	parameters := deploymentParameters{
+		Memory:    s.Settings.ContainerMemoryLimit,
+		CPU:       s.Settings.ContainerCPULimit,
+		Migration: s.WithMigration(),
+	}
+	if managed {
+		parameters.Managed, err = s.managedDatabase(instance)
+		if err != nil {
+			return s.Builder.DeployError(err)
+		}
+	}
 	params := services.DeploymentParameters{
-		ConfigMap: cm,
-		SecretMap: secrets,
+		ConfigMap:  cm,
+		SecretMap:  secrets,
+		Parameters: parameters,
 	}
 	var k *builderv0.KubernetesDeployment
 	if k, err = s.Builder.KubernetesDeploymentRequest(ctx, req); err != nil {
@@ -213,14 +345,52 @@ func (s *Builder) Deploy(ctx context.Context, req *builderv0.DeploymentRequest)
 	if err != nil {
 		return s.Builder.DeployError(err)
 	}
+	if managed {
+		err = s.deployManagedDatabase(ctx, req.Environment, k, params)
+		if err != nil {
+			return s.Builder.DeployError(err)
+		}
+	}
 	return s.Builder.DeployResponse()
 }
 
+// deploymentParameters of the kustomize templates: Kubernetes reads the quantities as they are
+type deploymentParameters struct {
+	// Memory and CPU requests and limits of the migration job and the managed database
+	Memory string
+	CPU    string
+
+	// Migration runs the migration job
+	Migration bool
+
+	// Managed database, nil for an external one
+	Managed *managedDatabase
+}
+
+// verifyConnection runs SELECT 1 on the database: typo'd credentials fail the deployment
+func (s *Builder) verifyConnection(ctx context.Context, connection string) error {
+	ctx, cancel := context.WithTimeout(ctx, verifyConnectionTimeout)
+	defer cancel()
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot open database")
+	}
+	defer db.Close()
+	if _, err = db.ExecContext(ctx, "SELECT 1"); err != nil {
+		return s.Wool.Wrapf(err, "cannot connect to the database with the deployment configuration")
+	}
+	return nil
+}
+
 func (s *Builder) Options() []*agentv0.Question {
 	return []*agentv0.Question{
 		communicate.NewConfirm(&agentv0.Message{Name: HotReload, Message: "Migration hot-reload (Recommended)?", Description: "codefly can restart your database when migration changes detected 🔎"}, true),
 		communicate.NewStringInput(&agentv0.Message{Name: DatabaseName, Message: "Name of the database?", Description: "Ensure encapsulation of your data"},
 			s.Base.Identity.Module),
+		communicate.NewChoice(&agentv0.Message{Name: MigrationFormat, Message: "Migration format?", Description: "The tool applying the SQL files of the migrations folder"},
+			&agentv0.Message{Name: migrations.GolangMigrateFormat, Message: "golang-migrate", Description: "up and down files: 1_name.up.sql (Recommended)"},
+			&agentv0.Message{Name: migrations.DbmateFormat, Message: "dbmate", Description: "one file per version: 1_name.sql"},
+			&agentv0.Message{Name: migrations.FlywayFormat, Message: "flyway", Description: "versioned files: V1__name.sql"}),
 	}
 }
 
@@ -248,6 +418,12 @@ func (s *Builder) Create(ctx context.Context, req *builderv0.CreateRequest) (*bu
 		if err != nil {
 			return s.Builder.CreateError(err)
 		}
+
+		choice, err := session.Choice(MigrationFormat)
+		if err != nil {
+			return s.Builder.CreateError(err)
+		}
+		s.Settings.MigrationFormat = choice.GetOption()
 	} else {
 		options := s.Options()
 		var err error
@@ -262,9 +438,20 @@ func (s *Builder) Create(ctx context.Context, req *builderv0.CreateRequest) (*bu
 			return s.Builder.CreateError(err)
 		}
 	}
+	if err := validateDatabaseName(s.Settings.DatabaseName); err != nil {
+		return s.Builder.CreateError(err)
+	}
+	// Older agents don't ask: golang-migrate stays the default
+	if s.Settings.MigrationFormat == "" {
+		s.Settings.MigrationFormat = migrations.GolangMigrateFormat
+	}
+	if err := s.Settings.Validate(); err != nil {
+		return s.Builder.CreateError(err)
+	}
 	c := create{DatabaseName: s.Settings.DatabaseName, TableName: s.Builder.Service.Name}
 
-	err := s.Templates(ctx, c, services.WithFactory(factoryFS))
+	err := s.Templates(ctx, c, services.WithFactory(factoryFS),
+		services.WithTemplate(migrationsFS, path.Join("migrations", s.Settings.MigrationFormat), "migrations"))
 	if err != nil {
 		return s.Builder.CreateError(err)
 	}
@@ -294,6 +481,11 @@ func (s *Builder) CreateEndpoints(ctx context.Context) error {
 //go:embed templates/factory
 var factoryFS embed.FS
 
+// Each migration format has its own scaffold
+//
+//go:embed templates/migrations
+var migrationsFS embed.FS
+
 //go:embed templates/builder
 var builderFS embed.FS
 
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/codefly-dev/core/resources"
+	"github.com/codefly-dev/core/wool"
+	"github.com/lib/pq"
+)
+
+// Authentication errors of postgres: invalid_password and invalid_authorization_specification
+const (
+	invalidPassword                   = "28P01"
+	invalidAuthorizationSpecification = "28000"
+)
+
+// isAuthenticationFailure is true when postgres rejected the credentials:
+// containerized migrations only report the message of the error
+func isAuthenticationFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == invalidPassword || pqErr.Code == invalidAuthorizationSpecification
+	}
+	return strings.Contains(err.Error(), "password authentication failed")
+}
+
+// withCredentialRefresh retries f once with fresh credentials when the password was rotated out-of-band
+func (s *Runtime) withCredentialRefresh(ctx context.Context, f func(ctx context.Context) error) error {
+	err := f(ctx)
+	if !isAuthenticationFailure(err) {
+		return err
+	}
+	s.Wool.Warn("authentication failed: reloading the credentials", wool.ErrField(err))
+	if errRefresh := s.refreshCredentials(ctx); errRefresh != nil {
+		return s.Wool.Wrapf(err, "cannot refresh credentials: %v", errRefresh)
+	}
+	return f(ctx)
+}
+
+// refreshCredentials re-reads the configuration, which may have been updated with the new secret,
+// and rebuilds every connection built from it
+func (s *Runtime) refreshCredentials(ctx context.Context) error {
+	connection, err := s.createConnectionString(ctx, s.Configuration, s.address, s.withSSL(s.Runtime.Environment))
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot create connection string")
+	}
+	if connection == s.connection {
+		return s.Wool.NewError("credentials are unchanged")
+	}
+	s.connection = connection
+	s.adminConnection, err = s.createAdminConnectionString(ctx, s.Configuration, s.address, s.withSSL(s.Runtime.Environment))
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot create admin connection string")
+	}
+
+	// The pool keeps connections authenticated with the old password
+	if s.db != nil {
+		if err = s.db.Close(); err != nil {
+			s.Wool.Warn("cannot close database", wool.ErrField(err))
+		}
+		s.db = nil
+	}
+
+	net, err := resources.FindNetworkMapping(ctx, s.NetworkMappings, s.TcpEndpoint)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot find network mapping")
+	}
+	s.Runtime.RuntimeConfigurations, err = s.runtimeConfigurations(ctx, net)
+	if err != nil {
+		return err
+	}
+
+	s.migrationConfig.Connection = connection
+	s.migrationConfig.AdminConnection = s.adminConnection
+	s.migrationConfig.ContainerConnection, err = s.containerConnection(ctx)
+	if err != nil {
+		return err
+	}
+	s.migrationConfig.Password = s.migrationPassword
+	err = s.migrationManager.Init(ctx, s.Runtime.RuntimeConfigurations)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot reload migration connections")
+	}
+	s.Wool.Info("credentials reloaded")
+	return nil
+}
+
+// syncPassword sets the configured password on the reused container, still initialized with the previous one
+func (s *Runtime) syncPassword(ctx context.Context) error {
+	connection, err := url.Parse(s.adminConnection)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot parse admin connection string")
+	}
+	connection.User = url.UserPassword(s.postgresUser, s.stalePassword)
+	admin, err := sql.Open("postgres", connection.String())
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot open admin database")
+	}
+	defer admin.Close()
+
+	// The container may still be starting
+	maxRetry := s.Settings.ReadinessRetries
+	if maxRetry <= 0 {
+		maxRetry = defaultReadinessRetries
+	}
+	delay := s.Settings.ReadinessDelay
+	if delay <= 0 {
+		delay = defaultReadinessDelay
+	}
+	delays := readinessDelays(maxRetry, delay)
+	for retry := 0; ; retry++ {
+		err = admin.PingContext(ctx)
+		if err == nil || isAuthenticationFailure(err) || retry == len(delays) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return s.Wool.Wrapf(ctx.Err(), "stopped waiting for the database: %v", err)
+		case <-time.After(withJitter(delays[retry])):
+		}
+	}
+	if isAuthenticationFailure(err) {
+		// A previous run synced it already
+		s.Wool.Debug("previous password rejected: keeping the current one")
+		s.stalePassword = ""
+		return nil
+	}
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot connect with the previous password")
+	}
+	_, err = admin.ExecContext(ctx, fmt.Sprintf("ALTER USER %s WITH PASSWORD %s", pq.QuoteIdentifier(s.postgresUser), pq.QuoteLiteral(s.postgresPassword)))
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot change password")
+	}
+	s.Wool.Info("password synced")
+	s.stalePassword = ""
+	return nil
+}
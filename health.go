@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	runtimev0 "github.com/codefly-dev/core/generated/go/codefly/services/runtime/v0"
+)
+
+// HealthState of the database, distinct from the readiness checked once at startup
+type HealthState string
+
+const (
+	// HealthContainerDown when the database doesn't accept connections
+	HealthContainerDown HealthState = "container-down"
+	// HealthMigrationsPending when the database accepts connections but is behind the migration files
+	HealthMigrationsPending HealthState = "migrations-pending"
+	HealthHealthy           HealthState = "healthy"
+)
+
+// healthTimeout bounds a probe: a health check must answer fast
+const healthTimeout = 2 * time.Second
+
+type HealthStatus struct {
+	State   HealthState
+	Message string
+}
+
+// Health pings the database with the runtime pool and checks the migrations are current
+func (s *Runtime) Health(ctx context.Context) *HealthStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	db, err := s.database()
+	if err == nil {
+		err = db.PingContext(ctx)
+	}
+	if err == nil {
+		_, err = db.ExecContext(ctx, "SELECT 1")
+	}
+	if err != nil {
+		return &HealthStatus{State: HealthContainerDown, Message: err.Error()}
+	}
+	if s.Settings.NoMigration || s.migrationManager == nil {
+		return &HealthStatus{State: HealthHealthy}
+	}
+	current, err := s.migrationManager.Current(ctx)
+	if err != nil {
+		return &HealthStatus{State: HealthMigrationsPending, Message: err.Error()}
+	}
+	if !current {
+		return &HealthStatus{State: HealthMigrationsPending, Message: "database is behind the migration files"}
+	}
+	return &HealthStatus{State: HealthHealthy}
+}
+
+// startStatus reports the health of a started database
+func (h *HealthStatus) startStatus() *runtimev0.StartStatus {
+	message := string(h.State)
+	if h.Message != "" {
+		message += ": " + h.Message
+	}
+	state := runtimev0.StartStatus_STARTED
+	if h.State == HealthContainerDown {
+		state = runtimev0.StartStatus_ERROR
+	}
+	return &runtimev0.StartStatus{State: state, Message: message}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/migrations"
+)
+
+// defaultHotReloadDebounce coalesces the events of an editor saving several migrations at once
+const defaultHotReloadDebounce = 500 * time.Millisecond
+
+// debouncer runs the last triggered function once no trigger happened for the window,
+// with the files changed since the previous run
+type debouncer struct {
+	sync.Mutex
+	window time.Duration
+	timer  *time.Timer
+	files  []string
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+	if window <= 0 {
+		window = defaultHotReloadDebounce
+	}
+	return &debouncer{window: window}
+}
+
+func (d *debouncer) trigger(file string, f func(files []string)) {
+	d.Lock()
+	defer d.Unlock()
+	if !slices.Contains(d.files, file) {
+		d.files = append(d.files, file)
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(d.window, func() {
+		d.Lock()
+		files := d.files
+		d.files = nil
+		d.Unlock()
+		f(files)
+	})
+}
+
+// stop drops a pending run
+func (d *debouncer) stop() {
+	d.Lock()
+	defer d.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.files = nil
+}
+
+// reloadMigrations applies a burst of changes in one run: an edited migration already applied is re-applied
+// with Update, new ones are applied after it
+func (s *Runtime) reloadMigrations(files []string) {
+	err := s.withCredentialRefresh(context.Background(), func(ctx context.Context) error {
+		return s.updateMigrations(ctx, files)
+	})
+	if err != nil {
+		s.Wool.Warn("cannot apply migrations", wool.ErrField(err))
+	}
+}
+
+// updateMigrations re-applies the edited migrations, then applies the new ones
+func (s *Runtime) updateMigrations(ctx context.Context, files []string) error {
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+
+	ctx, cancel := s.migrationContext(ctx)
+	defer cancel()
+
+	records, err := s.migrationManager.History(ctx)
+	if err != nil {
+		return err
+	}
+	// Update re-applies from the file down to the latest migration: once for the highest edited one
+	if edited := migrations.LatestApplied(records, files); edited != "" {
+		if err = s.migrationManager.Update(ctx, edited); err != nil {
+			return err
+		}
+	}
+	if s.Settings.UseAdvisoryLock {
+		return s.withAdvisoryLock(ctx, s.runMigrations)
+	}
+	return s.runMigrations(ctx)
+}
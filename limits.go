@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/codefly-dev/core/wool"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// memoryUnits of the Kubernetes quantities: binary ones first so Mi isn't read as M
+var memoryUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// parseMemory reads a quantity like 512Mi or 1G as bytes: 0 when empty
+func parseMemory(quantity string) (int64, error) {
+	w := wool.Get(context.Background()).In("parseMemory")
+	if quantity == "" {
+		return 0, nil
+	}
+	number, multiplier := quantity, 1.0
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(quantity, unit.suffix) {
+			number, multiplier = strings.TrimSuffix(quantity, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 || math.IsInf(value, 0) {
+		return 0, w.NewError("invalid memory quantity %q: use a quantity like 512Mi or 1G", quantity)
+	}
+	return int64(value * multiplier), nil
+}
+
+// parseCPU reads a quantity like 0.5 or 500m as nano CPUs, the unit of docker: 0 when empty
+func parseCPU(quantity string) (int64, error) {
+	w := wool.Get(context.Background()).In("parseCPU")
+	if quantity == "" {
+		return 0, nil
+	}
+	number, multiplier := quantity, 1e9
+	if strings.HasSuffix(quantity, "m") {
+		number, multiplier = strings.TrimSuffix(quantity, "m"), 1e6
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 || math.IsInf(value, 0) {
+		return 0, w.NewError("invalid CPU quantity %q: use a quantity like 0.5 or 500m", quantity)
+	}
+	return int64(value * multiplier), nil
+}
+
+// containerResources of the container-memory-limit and container-cpu-limit settings
+func (s *Service) containerResources() (container.Resources, error) {
+	memory, err := parseMemory(s.Settings.ContainerMemoryLimit)
+	if err != nil {
+		return container.Resources{}, err
+	}
+	cpus, err := parseCPU(s.Settings.ContainerCPULimit)
+	if err != nil {
+		return container.Resources{}, err
+	}
+	// Without swap, the memory limit is a hard one
+	return container.Resources{Memory: memory, MemorySwap: memory, NanoCPUs: cpus}, nil
+}
+
+// limitContainer applies the limits to the postgres container: the runner environment doesn't expose them
+func (s *Runtime) limitContainer(ctx context.Context) error {
+	limits, err := s.containerResources()
+	if err != nil {
+		return err
+	}
+	return s.withContainer(ctx, func(cli *client.Client, id string) error {
+		_, err := cli.ContainerUpdate(ctx, id, container.UpdateConfig{Resources: limits})
+		if err != nil {
+			return s.Wool.Wrapf(err, "cannot limit container resources")
+		}
+		return nil
+	})
+}
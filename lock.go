@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+
+	"github.com/codefly-dev/core/wool"
+)
+
+// advisoryLockID is shared by every runtime migrating the same database
+func advisoryLockID(database string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("codefly-migrations:" + database))
+	return int64(h.Sum64())
+}
+
+// withAdvisoryLock runs f while holding the migration advisory lock of the database:
+// replicas starting together wait for each other instead of migrating at the same time
+func (s *Runtime) withAdvisoryLock(ctx context.Context, f func(ctx context.Context) error) error {
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	// The lock belongs to the session: lock and unlock on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot get connection for the advisory lock")
+	}
+	defer conn.Close()
+
+	id := advisoryLockID(s.DatabaseName)
+	s.Wool.Debug("waiting for migration advisory lock", wool.Field("id", id))
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", id); err != nil {
+		return s.Wool.Wrapf(err, "cannot acquire migration advisory lock")
+	}
+	defer func() {
+		// The context may be done: the lock must still be released
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", id); err != nil {
+			s.Wool.Warn("cannot release migration advisory lock", wool.ErrField(err))
+		}
+	}()
+	return f(ctx)
+}
@@ -9,46 +9,245 @@ import (
 	"github.com/codefly-dev/core/templates"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/codefly-dev/core/agents"
 	"github.com/codefly-dev/core/agents/services"
 	agentv0 "github.com/codefly-dev/core/generated/go/codefly/services/agent/v0"
 	"github.com/codefly-dev/core/resources"
 	"github.com/codefly-dev/core/shared"
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
 )
 
 // Agent version
 var agent = shared.Must(resources.LoadFromFs[resources.Agent](shared.Embed(infoFS)))
 
-var requirements = builders.NewDependencies(agent.Name,
-	builders.NewDependency("service.codefly.yaml"),
-	builders.NewDependency("migrations", "migrations").WithPathSelect(shared.NewSelect("*.sql")),
-)
+var requirements = newRequirements(defaultMigrationDir, "*.sql")
+
+// defaultMigrationDir of the service when no directory is set for the environment
+const defaultMigrationDir = "migrations"
+
+// newRequirements watches the service definition and the migration files of the directory matching the patterns
+func newRequirements(migrationDir string, patterns ...string) *builders.Dependencies {
+	return builders.NewDependencies(agent.Name,
+		builders.NewDependency("service.codefly.yaml"),
+		migrationDependency(migrationDir, patterns...),
+	)
+}
+
+// migrationDependency is the migration files of a directory matching the patterns
+func migrationDependency(migrationDir string, patterns ...string) *builders.Dependency {
+	return builders.NewDependency(migrationDir, migrationDir).WithPathSelect(shared.NewSelect(patterns...))
+}
 
 type Settings struct {
 	DatabaseName string `yaml:"database-name"`
 	HotReload    bool   `yaml:"hot-reload"`
 
-	WithoutSSL  bool `yaml:"without-ssl"`  // Default to SSL
-	NoMigration bool `yaml:"no-migration"` // Developer only
+	AdminDatabase string `yaml:"admin-database"` // Existing database of the admin operations like CREATE DATABASE, defaults to postgres
+
+	HotReloadDebounce time.Duration `yaml:"hot-reload-debounce"` // Changes within the window are applied at once, defaults to 500ms
+
+	WithoutSSL  *bool `yaml:"without-ssl"`  // Default to SSL except in the local environment
+	NoMigration bool  `yaml:"no-migration"` // Developer only
+
+	VerifyConnectionOnDeploy bool `yaml:"verify-connection-on-deploy"` // SELECT 1 with the deployment credentials before deploying
+
+	ConnectionFormat string `yaml:"connection-format"` // url (default) or keyword
+	ExportDSN        bool   `yaml:"export-dsn"`        // Also export connection-dsn: the connection in the keyword form, for the tools needing it next to the URL
+	UseUnixSocket    bool   `yaml:"use-unix-socket"`   // Local addresses connect through the socket in /var/run/postgresql
+
+	ReadReplicaAddress string `yaml:"read-replica-address"` // host:port of a replica: exported as connection-readonly
+
+	PoolingMode string `yaml:"pooling-mode"` // session (default), transaction or statement: pooler the clients connect through
+
+	ContainerMemoryLimit string `yaml:"container-memory-limit"` // Quantity like 512Mi: postgres and migration containers, and the deployment
+	ContainerCPULimit    string `yaml:"container-cpu-limit"`    // Quantity like 0.5 or 500m: postgres and migration containers, and the deployment
+
+	EnablePgBouncer   bool   `yaml:"enable-pgbouncer"`    // Runtime: dependencies connect through a PgBouncer container in the pooling-mode, migrations directly
+	PgBouncerPort     uint16 `yaml:"pgbouncer-port"`      // Host port of PgBouncer, defaults to 6432
+	PgBouncerPoolSize int    `yaml:"pgbouncer-pool-size"` // Server connections per user and database, defaults to 20
+
+	StopBehavior string `yaml:"stop-behavior"` // keep-alive (default), stop or pause
+
+	ExistingContainerPolicy string `yaml:"existing-container-policy"` // reuse (default), recreate or fail: container left by a previous run
+	ReuseContainer          bool   `yaml:"reuse-container"`           // reuse policy: adopt the container without pulling when image, credentials and port match, recreate it otherwise
+
+	RotatePassword bool `yaml:"rotate-password"` // A reused container initialized with another password keeps its data: the password is changed with ALTER USER
+
+	DockerNetwork string `yaml:"docker-network"` // Existing network joined by the database and the migration containers
+
+	ImageRegistryPrefix string `yaml:"image-registry-prefix"` // Mirror of the default postgres and migration images: registry.internal/mirror
+
+	FallbackImage string `yaml:"fallback-image"` // Used only when the postgres image can't be pulled
+
+	HostAuthMethod string `yaml:"host-auth-method"` // trust, scram-sha-256 or md5: POSTGRES_HOST_AUTH_METHOD of the local database, trust needs no password and is refused outside of the local environment
+
+	// Only applied when the data directory is initialized: a running database keeps its locale
+	InitdbArgs string `yaml:"initdb-args"` // Passed as POSTGRES_INITDB_ARGS
+	Locale     string `yaml:"locale"`      // Passed as LANG and LC_COLLATE
+
+	ServerParameters map[string]string `yaml:"server-parameters"` // postgres -c key=value of the local database: shared_buffers, max_connections...
+
+	PreStartCommand []string `yaml:"pre-start-command"` // Run in the postgres container before the readiness check, on every start: it must be idempotent
+
+	DefaultSearchPath string `yaml:"default-search-path"` // Comma-separated schemas of the exported connection and the migrations: the first one is created before the migrations
+
+	PostgresConfPath string `yaml:"postgres-conf-path"` // postgresql.conf of the local database, relative to the service: exclusive with server-parameters, keep listen_addresses = '*'
+
+	BackupBeforeMigration bool `yaml:"backup-before-migration"` // pg_dump in backups/ before applying migrations
+
+	MigrationUser       string `yaml:"migration-user"`        // Role running the migrations, password from MIGRATION_PASSWORD
+	CreateMigrationRole bool   `yaml:"create-migration-role"` // Create the migration role with the superuser
+
+	MigrationFormat  string        `yaml:"migration-format"`  // gomigrate (default), dbmate, flyway or auto to detect it from the files
+	MigrationsTable  string        `yaml:"migrations-table"`  // Defaults to the table of the migration format
+	Schema           string        `yaml:"schema"`            // gomigrate: schema of the migrations, created when missing
+	MigrationTimeout time.Duration `yaml:"migration-timeout"` // Defaults to 3s
+	ApplyTimeout     time.Duration `yaml:"apply-timeout"`     // Bounds a whole migration run, no limit by default
+
+	MigrateToVersion string `yaml:"migrate-to-version"` // gomigrate or flyway: stop at this migration, gomigrate migrates down to it, latest by default
+
+	MigrationPGOptions string `yaml:"migration-pg-options"` // Session options of the migrations, e.g. "-c lock_timeout=5s" to fail fast behind a long transaction
+
+	MigrationConnectRetries int `yaml:"migration-connect-retries"` // gomigrate: attempts to reach the database with backoff, derived from migration-timeout by default
+
+	MultiStatementEnabled bool          `yaml:"multi-statement-enabled"`  // gomigrate: run statements one by one, without the implicit transaction
+	MultiStatementMaxSize int           `yaml:"multi-statement-max-size"` // gomigrate: largest migration in bytes with multi-statement-enabled, defaults to 10MB
+	StatementTimeout      time.Duration `yaml:"statement-timeout"`        // gomigrate: bounds each statement, no limit by default
+
+	AutoRecoverDirty bool `yaml:"auto-recover-dirty"` // gomigrate: force a dirty version back to the last clean one and retry
+
+	ResetSchemaOnStart bool `yaml:"reset-schema-on-start"` // Local only: drop the public schema and its data before the migrations
+	TruncateOnStart    bool `yaml:"truncate-on-start"`     // Local only: empty the tables after the migrations, keeping the schema
+
+	Roles []RoleSpec `yaml:"roles"` // Created before the migrations, passwords rotated on every start
+
+	SeedDir  string `yaml:"seed-dir"`  // .sql files applied after the migrations on every start, relative to the service
+	RunSeeds bool   `yaml:"run-seeds"` // Apply the seeds even with no-migration
+
+	VerificationQuery   string        `yaml:"verification-query"`   // Must return a single truthy value after migrations: the start fails otherwise
+	VerificationTimeout time.Duration `yaml:"verification-timeout"` // Bounds the verification query, defaults to 10s
+
+	MigrationWatchPatterns []string `yaml:"migration-watch-patterns"` // Defaults to the files of the migration format
+
+	MigrationDirByEnvironment map[string]string `yaml:"migration-dir-by-environment"` // Environment name to a directory relative to the service, defaults to migrations
+	MigrationDirs             []string          `yaml:"migration-dirs"`               // Directories relative to the service applied in order, each fully before the next: replaces the directory of the environment
+
+	SkipApplyWhenCurrent bool `yaml:"skip-apply-when-current"` // Default to true
+	UseAdvisoryLock      bool `yaml:"use-advisory-lock"`       // Default to true: replicas migrate one at a time
+
+	ReadinessRetries int           `yaml:"readiness-retries"` // Attempts to reach the database, defaults to 7
+	ReadinessDelay   time.Duration `yaml:"readiness-delay"`   // First delay between attempts, doubled up to 10s with jitter, defaults to 500ms
+	ReadinessQuery   string        `yaml:"readiness-query"`   // Replaces SELECT 1: the database is ready once it returns a row, like SELECT 1 FROM pg_extension WHERE extname = 'vector'
+
+	GenerateGoModels bool   `yaml:"generate-go-models"` // Go structs from the migrated schema
+	GoModelsPath     string `yaml:"go-models-path"`     // Relative to the service, defaults to models
+
+	SchemaDumpPath string `yaml:"schema-dump-path"` // JSON of the tables, columns and indexes written after the migrations, relative to the service
+
+	VerifyIdempotent bool `yaml:"verify-idempotent"` // Replay migrations on a shadow database during test
+
+	ProbePort uint16 `yaml:"probe-port"` // Serves /healthz, /readyz and /metrics over HTTP from the start, disabled by default
+
+	AdminTimeout time.Duration `yaml:"admin-timeout"` // Bounds a statement run with Runtime.Admin, defaults to 30s
+
+	DeployMode  string `yaml:"deploy-mode"`  // external (default) or managed
+	StorageSize string `yaml:"storage-size"` // managed: size of the data volume, defaults to 10Gi
 }
 
+// Deploy modes: an external database only gets the connection configuration and the migration job,
+// a managed one is deployed as a StatefulSet with its data volume
+const (
+	ExternalDeployMode = "external"
+	ManagedDeployMode  = "managed"
+)
+
+// Pooling modes of a pooler like PgBouncer in front of the database
+const (
+	SessionPoolingMode     = "session"
+	TransactionPoolingMode = "transaction"
+	StatementPoolingMode   = "statement"
+)
+
+// Formats of the exported connection string
+const (
+	URLConnectionFormat     = "url"
+	KeywordConnectionFormat = "keyword"
+)
+
+// What Stop does with the postgres container
+const (
+	KeepAliveStopBehavior = "keep-alive"
+	StopStopBehavior      = "stop"
+	PauseStopBehavior     = "pause"
+)
+
+// Authentication methods of the local database
+const (
+	TrustHostAuthMethod       = "trust"
+	ScramSHA256HostAuthMethod = "scram-sha-256"
+	MD5HostAuthMethod         = "md5"
+)
+
+// What Init does with a container of the same name left by a previous run
+const (
+	ReuseExistingContainerPolicy    = "reuse"
+	RecreateExistingContainerPolicy = "recreate"
+	FailExistingContainerPolicy     = "fail"
+)
+
 const HotReload = "hot-reload"
 const DatabaseName = "database-name"
+const MigrationFormat = "migration-format"
+
+// databaseName is quoted in every statement, so hyphens are fine: it must not start with a digit
+// nor be longer than the 63 bytes postgres keeps of an identifier
+var databaseName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]{0,62}$`)
+
+// validateDatabaseName rejects a name which would only fail once in the container
+func validateDatabaseName(name string) error {
+	if !databaseName.MatchString(name) {
+		return wool.Get(context.Background()).In("validateDatabaseName").NewError(
+			"invalid database-name %q: use at most 63 letters, digits, underscores or hyphens, not starting with a digit", name)
+	}
+	return nil
+}
 
 var image = &resources.DockerImage{Name: "postgres", Tag: "16.1-alpine"}
 
+// runtimeImage is the postgres image the service resolves to: the builder reports it and the runtime runs it
+func (s *Service) runtimeImage() *resources.DockerImage {
+	return oneshot.WithRegistry(s.Settings.ImageRegistryPrefix, image)
+}
+
+// defaultAdminDatabase is created with every postgres cluster
+const defaultAdminDatabase = "postgres"
+
+// unixSocketDirectory is the default socket directory of postgres
+const unixSocketDirectory = "/var/run/postgresql"
+
 type Service struct {
 	*services.Base
 
 	// Settings
 	*Settings
 
-	postgresUser     string
-	postgresPassword string
-	connectionKey    string
-	connection       string
+	postgresUser      string
+	postgresPassword  string
+	migrationPassword string
+	readOnlyUser      string
+	readOnlyPassword  string
+	connectionKey     string
+	connection        string
+	adminConnection   string
 
 	TcpEndpoint *basev0.Endpoint
 }
@@ -70,36 +269,141 @@ func (s *Service) GetAgentInformation(ctx context.Context, _ *agentv0.AgentInfor
 		ConfigurationDetails: []*agentv0.ConfigurationValueDetail{
 			{
 				Name: "postgres", Description: "postgres credentials",
-				Fields: []*agentv0.ConfigurationValueInformation{
-					{
-						Name: "connection", Description: "connection string",
-					},
-				}},
+				Fields: connectionFields(),
+			},
 		},
 		ReadMe: readme,
 	}, nil
 }
 
+// Keys of the postgres configuration created for the dependencies of the service
+const (
+	connectionKey         = "connection"
+	readOnlyConnectionKey = "connection-readonly"
+	dsnConnectionKey      = "connection-dsn"
+)
+
+// connectionValues created by CreateConnectionConfiguration: all of them are secrets
+var connectionValues = []struct {
+	key         string
+	description string
+}{
+	{connectionKey, "connection string in the connection-format, url by default"},
+	{readOnlyConnectionKey, "read-only connection string: POSTGRES_RO_USER or the user with default_transaction_read_only, to the replica when read-replica-address is set and not for containers"},
+	{dsnConnectionKey, "connection string in the libpq keyword form, only with export-dsn"},
+}
+
+// connectionFields describes the values of the postgres configuration for discovery tooling
+func connectionFields() []*agentv0.ConfigurationValueInformation {
+	var fields []*agentv0.ConfigurationValueInformation
+	for _, value := range connectionValues {
+		fields = append(fields, &agentv0.ConfigurationValueInformation{
+			Name:        value.key,
+			Description: fmt.Sprintf("%s (secret)", value.description),
+		})
+	}
+	return fields
+}
+
 func NewService() *Service {
 	return &Service{
 		Base:     services.NewServiceBase(context.Background(), agent.Of(resources.ServiceAgent)),
-		Settings: &Settings{},
+		Settings: &Settings{SkipApplyWhenCurrent: true, UseAdvisoryLock: true},
 	}
 }
 
+// credential reads a credential from the postgres configuration, then from the process environment:
+// pipelines can inject secrets without a configuration
+func (s *Service) credential(ctx context.Context, conf *basev0.Configuration, key string) (string, error) {
+	value, err := resources.GetConfigurationValue(ctx, conf, "postgres", key)
+	if err != nil {
+		return "", err
+	}
+	if value != "" {
+		s.Wool.Trace("credential from the configuration", wool.Field("key", key))
+		return value, nil
+	}
+	value = os.Getenv(key)
+	if value != "" {
+		s.Wool.Debug("credential from the environment", wool.Field("key", key))
+	}
+	return value, nil
+}
+
+// ValidateConfiguration checks the credentials are in the postgres configuration or the environment: a missing key is read as empty
+func (s *Service) ValidateConfiguration(ctx context.Context, conf *basev0.Configuration) error {
+	keys := []struct{ key, what string }{
+		{"POSTGRES_USER", "user"},
+		{"POSTGRES_PASSWORD", "password"},
+	}
+	// trust authenticates the user without a password
+	if s.Settings.HostAuthMethod == TrustHostAuthMethod {
+		keys = keys[:1]
+	}
+	for _, required := range keys {
+		value, err := s.credential(ctx, conf, required.key)
+		if err != nil {
+			return s.Wool.Wrapf(err, "cannot get %s", required.what)
+		}
+		if value == "" {
+			return s.Wool.NewError("cannot get %s: %s is missing from the postgres configuration and the environment", required.what, required.key)
+		}
+	}
+	return nil
+}
+
 func (s *Service) LoadConfiguration(ctx context.Context, conf *basev0.Configuration) error {
-	var err error
-	s.postgresUser, err = resources.GetConfigurationValue(ctx, conf, "postgres", "POSTGRES_USER")
+	err := s.ValidateConfiguration(ctx, conf)
+	if err != nil {
+		return err
+	}
+	s.postgresUser, err = s.credential(ctx, conf, "POSTGRES_USER")
 	if err != nil {
 		return s.Wool.Wrapf(err, "cannot get user")
 	}
-	s.postgresPassword, err = resources.GetConfigurationValue(ctx, conf, "postgres", "POSTGRES_PASSWORD")
+	s.postgresPassword, err = s.credential(ctx, conf, "POSTGRES_PASSWORD")
 	if err != nil {
 		return s.Wool.Wrapf(err, "cannot get password")
 	}
+	// Optional: only used with a migration user
+	s.migrationPassword, err = s.credential(ctx, conf, "MIGRATION_PASSWORD")
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot get migration password")
+	}
+	// Optional: the read-only connection falls back to the user in read-only transactions
+	s.readOnlyUser, err = s.credential(ctx, conf, "POSTGRES_RO_USER")
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot get read-only user")
+	}
+	s.readOnlyPassword, err = s.credential(ctx, conf, "POSTGRES_RO_PASSWORD")
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot get read-only password")
+	}
+	if (s.readOnlyUser == "") != (s.readOnlyPassword == "") {
+		return s.Wool.NewError("POSTGRES_RO_USER and POSTGRES_RO_PASSWORD must be set together")
+	}
 	return nil
 }
 
+// checkHostAuthMethod refuses trust outside of the local environment: anyone reaching the database would be let in
+func (s *Service) checkHostAuthMethod(env *basev0.Environment) error {
+	if s.Settings.HostAuthMethod != TrustHostAuthMethod {
+		return nil
+	}
+	if env != nil && resources.EnvironmentFromProto(env).Local() {
+		return nil
+	}
+	return s.Wool.NewError("host-auth-method trust is only allowed in the local environment")
+}
+
+// withSSL is true unless without-ssl is set or the environment is local: databases outside of it get SSL
+func (s *Service) withSSL(env *basev0.Environment) bool {
+	if s.Settings.WithoutSSL != nil {
+		return !*s.Settings.WithoutSSL
+	}
+	return env == nil || !resources.EnvironmentFromProto(env).Local()
+}
+
 func (s *Service) createConnectionString(ctx context.Context, conf *basev0.Configuration, address string, withSSL bool) (string, error) {
 	defer s.Wool.Catch()
 	ctx = s.Wool.Inject(ctx)
@@ -108,12 +412,95 @@ func (s *Service) createConnectionString(ctx context.Context, conf *basev0.Confi
 	if err != nil {
 		return "", s.Wool.Wrapf(err, "cannot get user and password")
 	}
+	address = hostAddress(address)
+
+	// Escape the credentials so the connection string can always be parsed back
+	conn := url.URL{
+		Scheme: "postgresql",
+		User:   url.UserPassword(s.postgresUser, s.postgresPassword),
+		Host:   address,
+		Path:   "/" + s.DatabaseName,
+	}
+	if s.postgresPassword == "" {
+		conn.User = url.User(s.postgresUser)
+	}
+	query := url.Values{}
+	if s.Settings.UseUnixSocket && isLocalAddress(address) {
+		// libpq reads the socket directory from the host parameter: there is no TLS on a socket
+		conn.Host = ""
+		query.Set("host", unixSocketDirectory)
+	} else if !withSSL || strings.Contains(address, "localhost") || strings.Contains(address, "host.docker.internal") {
+		query.Set("sslmode", "disable")
+	}
+	if s.Settings.DefaultSearchPath != "" {
+		appendOption(query, searchPathOption(s.Settings.DefaultSearchPath))
+	}
+	conn.RawQuery = query.Encode()
+	return conn.String(), nil
+}
+
+// searchPathOption sets the search path of every session of the connection
+func searchPathOption(searchPath string) string {
+	return fmt.Sprintf("-c search_path=%s", searchPath)
+}
+
+// appendOption adds a session option to the options parameter of a connection string
+func appendOption(query url.Values, option string) {
+	if options := query.Get("options"); options != "" {
+		option = options + " " + option
+	}
+	query.Set("options", option)
+}
+
+// createAdminConnectionString connects to the admin database: a database can't be created or dropped from itself
+func (s *Service) createAdminConnectionString(ctx context.Context, conf *basev0.Configuration, address string, withSSL bool) (string, error) {
+	connection, err := s.createConnectionString(ctx, conf, address, withSSL)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", s.Wool.Wrapf(err, "cannot parse connection string")
+	}
+	u.Path = "/" + s.adminDatabase()
+	return u.String(), nil
+}
+
+func (s *Service) adminDatabase() string {
+	if s.Settings.AdminDatabase == "" {
+		return defaultAdminDatabase
+	}
+	return s.Settings.AdminDatabase
+}
 
-	conn := fmt.Sprintf("postgresql://%s:%s@%s/%s", s.postgresUser, s.postgresPassword, address, s.DatabaseName)
-	if !withSSL || strings.Contains(address, "localhost") || strings.Contains(address, "host.docker.internal") {
-		conn += "?sslmode=disable"
+// hostAddress brackets an IPv6 literal joined to its port without them, like ::1:5432:
+// the other addresses are kept as they are
+func hostAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return address
+	}
+	host, port := address[:i], address[i+1:]
+	if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+		return address
 	}
-	return conn, nil
+	return net.JoinHostPort(host, port)
+}
+
+// isLocalAddress is true for a host:port on the loopback interface
+func isLocalAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func (s *Service) CreateConnectionConfiguration(ctx context.Context, conf *basev0.Configuration, instance *basev0.NetworkInstance, withSSL bool) (*basev0.Configuration, error) {
@@ -123,21 +510,196 @@ func (s *Service) CreateConnectionConfiguration(ctx context.Context, conf *basev
 	if err != nil {
 		return nil, s.Wool.Wrapf(err, "cannot create connection string")
 	}
+	// Both forms come from the same connection: they keep the same credentials and parameters
+	pooled, err := s.withPoolingParameters(connection)
+	if err != nil {
+		return nil, err
+	}
+	connection, err = s.formatConnectionString(pooled)
+	if err != nil {
+		return nil, err
+	}
+	values := []*basev0.ConfigurationValue{
+		{Key: connectionKey, Value: connection, Secret: true},
+	}
+
+	readonly, err := s.createReadOnlyConnectionString(ctx, conf, instance, withSSL)
+	if err != nil {
+		return nil, s.Wool.Wrapf(err, "cannot create read-only connection string")
+	}
+	readonly, err = s.exportConnectionString(readonly)
+	if err != nil {
+		return nil, err
+	}
+	values = append(values, &basev0.ConfigurationValue{Key: readOnlyConnectionKey, Value: readonly, Secret: true})
+
+	if s.Settings.ExportDSN {
+		dsn, err := keywordConnectionString(pooled)
+		if err != nil {
+			return nil, s.Wool.Wrapf(err, "cannot create keyword connection string")
+		}
+		values = append(values, &basev0.ConfigurationValue{Key: dsnConnectionKey, Value: dsn, Secret: true})
+	}
 
 	outputConf := &basev0.Configuration{
 		Origin:         s.Base.Unique(),
 		RuntimeContext: resources.RuntimeContextFromInstance(instance),
 		Infos: []*basev0.ConfigurationInformation{
 			{Name: "postgres",
-				ConfigurationValues: []*basev0.ConfigurationValue{
-					{Key: "connection", Value: connection, Secret: true},
-				},
+				ConfigurationValues: values,
 			},
 		},
 	}
 	return outputConf, nil
 }
 
+// readOnlyTransactions makes every transaction of the primary user read-only
+const readOnlyTransactions = "-c default_transaction_read_only=on"
+
+// createReadOnlyConnectionString connects with the read-only user, or the user in read-only transactions,
+// to the replica when the instance can reach it
+func (s *Service) createReadOnlyConnectionString(ctx context.Context, conf *basev0.Configuration, instance *basev0.NetworkInstance, withSSL bool) (string, error) {
+	address := instance.Address
+	if s.withReadReplica(instance) {
+		address = s.Settings.ReadReplicaAddress
+	}
+	connection, err := s.createConnectionString(ctx, conf, address, withSSL)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", s.Wool.Wrapf(err, "cannot parse connection string")
+	}
+	query := u.Query()
+	if s.readOnlyUser != "" {
+		u.User = url.UserPassword(s.readOnlyUser, s.readOnlyPassword)
+	} else {
+		appendOption(query, readOnlyTransactions)
+	}
+	if s.withReadReplica(instance) {
+		query.Set("target_session_attrs", "read-only")
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// withReadReplica is true when the replica is reachable from the instance:
+// the replica address is a host one, it can't be used from containers
+func (s *Service) withReadReplica(instance *basev0.NetworkInstance) bool {
+	if s.Settings.ReadReplicaAddress == "" {
+		return false
+	}
+	return instance.Access == nil || instance.Access.Kind != resources.NetworkAccessContainer
+}
+
+// exportConnectionString adds the pooling parameters and applies the connection format
+func (s *Service) exportConnectionString(connection string) (string, error) {
+	connection, err := s.withPoolingParameters(connection)
+	if err != nil {
+		return "", err
+	}
+	return s.formatConnectionString(connection)
+}
+
+// withPoolingParameters lets pgx clients work behind a transaction or statement pooler:
+// no prepared statements, so no statement cache either
+func (s *Service) withPoolingParameters(connection string) (string, error) {
+	switch s.Settings.PoolingMode {
+	case "", SessionPoolingMode:
+		return connection, nil
+	case TransactionPoolingMode, StatementPoolingMode:
+		for _, param := range [][2]string{
+			{"default_query_exec_mode", "simple_protocol"},
+			{"statement_cache_capacity", "0"},
+			{"description_cache_capacity", "0"},
+		} {
+			var err error
+			connection, err = withQueryParameter(connection, param[0], param[1])
+			if err != nil {
+				return "", s.Wool.Wrapf(err, "cannot add pooling parameters")
+			}
+		}
+		return connection, nil
+	default:
+		return "", s.Wool.NewError("unknown pooling mode: %s", s.Settings.PoolingMode)
+	}
+}
+
+// formatConnectionString applies the connection format of the settings to a URL connection string
+func (s *Service) formatConnectionString(connection string) (string, error) {
+	switch s.Settings.ConnectionFormat {
+	case "", URLConnectionFormat:
+		return connection, nil
+	case KeywordConnectionFormat:
+		keyword, err := keywordConnectionString(connection)
+		if err != nil {
+			return "", s.Wool.Wrapf(err, "cannot create keyword connection string")
+		}
+		return keyword, nil
+	default:
+		return "", s.Wool.NewError("unknown connection format: %s", s.Settings.ConnectionFormat)
+	}
+}
+
+// withQueryParameter adds a parameter to a URL connection string
+func withQueryParameter(connection string, key string, value string) (string, error) {
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// keywordConnectionString translates a URL connection string to the libpq keyword/value form
+func keywordConnectionString(connection string) (string, error) {
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", err
+	}
+	var params []string
+	add := func(key string, value string) {
+		params = append(params, fmt.Sprintf("%s=%s", key, keywordValue(value)))
+	}
+	// A socket connection has its directory in the query
+	if host := u.Hostname(); host != "" {
+		add("host", host)
+	}
+	if port := u.Port(); port != "" {
+		add("port", port)
+	}
+	if u.User != nil {
+		add("user", u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			add("password", password)
+		}
+	}
+	add("dbname", strings.TrimPrefix(u.Path, "/"))
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		add(key, query.Get(key))
+	}
+	return strings.Join(params, " "), nil
+}
+
+// keywordValue quotes a value when libpq requires it
+func keywordValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " '\\") {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return fmt.Sprintf("'%s'", value)
+}
+
 func main() {
 	agents.Register(
 		services.NewServiceAgent(agent.Of(resources.ServiceAgent), NewService()),
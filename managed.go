@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"path"
+
+	"github.com/codefly-dev/core/agents/services"
+	basev0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
+	builderv0 "github.com/codefly-dev/core/generated/go/codefly/services/builder/v0"
+	"github.com/codefly-dev/core/resources"
+)
+
+// defaultStorageSize of the data volume of a managed database
+const defaultStorageSize = "10Gi"
+
+// postgresDataDirectory is a sub-directory of the volume: initdb refuses the lost+found of a fresh volume
+const postgresDataDirectory = "/var/lib/postgresql/data/pgdata"
+
+// managedDatabase is the postgres StatefulSet of the managed deploy mode
+type managedDatabase struct {
+	Image         string
+	Port          uint32
+	StorageSize   string
+	DataDirectory string
+
+	// Args replace the command of the image to pass the server parameters
+	Args []string
+
+	// SecretMap initializes the database: user, password and database name
+	SecretMap services.EnvironmentMap
+}
+
+// managedDatabase deployed behind the network instance of the service
+func (s *Builder) managedDatabase(instance *basev0.NetworkInstance) (*managedDatabase, error) {
+	managed := &managedDatabase{
+		Image:         s.runtimeImage().FullName(),
+		Port:          instance.Port,
+		StorageSize:   s.Settings.StorageSize,
+		DataDirectory: postgresDataDirectory,
+	}
+	if managed.StorageSize == "" {
+		managed.StorageSize = defaultStorageSize
+	}
+	if len(s.Settings.ServerParameters) > 0 {
+		args, err := s.serverCommand()
+		if err != nil {
+			return nil, err
+		}
+		managed.Args = args
+	}
+	if s.Settings.PostgresConfPath != "" {
+		s.Wool.Warn("postgres-conf-path is only mounted locally: use server-parameters for a managed database")
+	}
+	secrets, err := services.EnvsAsSecretData(s.containerEnvironment()...)
+	if err != nil {
+		return nil, err
+	}
+	managed.SecretMap = secrets
+	return managed, nil
+}
+
+// deployManagedDatabase writes the postgres kustomization next to the base one: the overlay of the environment includes it
+func (s *Builder) deployManagedDatabase(ctx context.Context, env *basev0.Environment, k *builderv0.KubernetesDeployment, params services.DeploymentParameters) error {
+	wrapper := &services.DeploymentWrapper{
+		DeploymentBase: &services.DeploymentBase{
+			Information: s.Information,
+			Namespace:   k.Namespace,
+			Environment: resources.EnvironmentFromProto(env),
+		},
+		Deployment: params,
+	}
+	return s.Templates(ctx, wrapper,
+		services.WithTemplate(deploymentFS, "deployment/managed", "").WithDestination(path.Join(k.Destination, "postgres")))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// migrationMetrics of the runtime: core has no metrics sink, Metrics dumps them in the Prometheus text format
+type migrationMetrics struct {
+	sync.Mutex
+	format   string
+	database string
+
+	duration  time.Duration
+	successes int
+	failures  int
+	version   float64
+	versioned bool
+}
+
+func newMigrationMetrics(format string, database string) *migrationMetrics {
+	return &migrationMetrics{format: format, database: database}
+}
+
+// record an apply: the version gauge keeps the last successful version
+func (m *migrationMetrics) record(duration time.Duration, version string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.duration = duration
+	if err != nil {
+		m.failures++
+		return
+	}
+	m.successes++
+	if v, errParse := strconv.ParseFloat(version, 64); errParse == nil {
+		m.version = v
+		m.versioned = true
+	}
+}
+
+func (m *migrationMetrics) String() string {
+	m.Lock()
+	defer m.Unlock()
+	labels := func(extra ...string) string {
+		pairs := []string{fmt.Sprintf("format=%q", m.format), fmt.Sprintf("database=%q", m.database)}
+		pairs = append(pairs, extra...)
+		sort.Strings(pairs)
+		return "{" + strings.Join(pairs, ",") + "}"
+	}
+	var out strings.Builder
+	out.WriteString("# TYPE postgres_migration_duration_seconds gauge\n")
+	fmt.Fprintf(&out, "postgres_migration_duration_seconds%s %g\n", labels(), m.duration.Seconds())
+	out.WriteString("# TYPE postgres_migration_runs_total counter\n")
+	fmt.Fprintf(&out, "postgres_migration_runs_total%s %d\n", labels(`result="success"`), m.successes)
+	fmt.Fprintf(&out, "postgres_migration_runs_total%s %d\n", labels(`result="failure"`), m.failures)
+	if m.versioned {
+		out.WriteString("# TYPE postgres_migration_version gauge\n")
+		fmt.Fprintf(&out, "postgres_migration_version%s %g\n", labels(), m.version)
+	}
+	return out.String()
+}
+
+// Metrics of the migrations applied by the runtime
+func (s *Runtime) Metrics() string {
+	if s.metrics == nil {
+		return ""
+	}
+	return s.metrics.String()
+}
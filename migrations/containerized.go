@@ -0,0 +1,110 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	basev0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
+	"github.com/codefly-dev/core/resources"
+	"github.com/codefly-dev/core/wool"
+)
+
+// containerized is shared by the managers migrating from a container:
+// the container uses the container connection, the agent checks the database on its own one
+type containerized struct {
+	*Config
+	w *wool.Wool
+
+	nativeConnection    string
+	containerConnection string
+}
+
+func (c *containerized) Init(ctx context.Context, configurations []*basev0.Configuration) error {
+	var err error
+	if c.ContainerConnection != "" {
+		// Connection is reachable from the agent wherever it runs
+		c.nativeConnection, c.containerConnection = c.Connection, c.ContainerConnection
+	} else {
+		c.nativeConnection, c.containerConnection, err = connections(ctx, configurations)
+		if err != nil {
+			return c.w.Wrapf(err, "cannot get connections")
+		}
+	}
+	c.nativeConnection, err = c.asMigrationUser(c.nativeConnection)
+	if err != nil {
+		return c.w.Wrapf(err, "cannot create migration connection string")
+	}
+	c.containerConnection, err = c.asMigrationUser(c.containerConnection)
+	if err != nil {
+		return c.w.Wrapf(err, "cannot create migration connection string")
+	}
+	c.containerConnection, err = c.inNetwork(c.containerConnection)
+	if err != nil {
+		return c.w.Wrapf(err, "cannot create network connection string")
+	}
+	c.checkSSL()
+	return nil
+}
+
+// checkSSL logs the connection of the migration containers once: they must negotiate TLS like the agent
+func (c *containerized) checkSSL() {
+	container, err := url.Parse(c.containerConnection)
+	if err != nil {
+		c.w.Warn("cannot parse container connection", wool.ErrField(err))
+		return
+	}
+	c.w.Debug("migration container connection", wool.Field("connection", MaskConnectionString(c.containerConnection)))
+	native, err := url.Parse(c.nativeConnection)
+	// No TLS on a unix socket
+	if err != nil || native.Query().Has("host") {
+		return
+	}
+	if sslmode := container.Query().Get("sslmode"); sslmode != native.Query().Get("sslmode") {
+		c.w.Warn("migration containers and agent use different SSL modes",
+			wool.Field("container", sslmode), wool.Field("agent", native.Query().Get("sslmode")))
+	}
+}
+
+// verificationConnection is the connection reachable from where the agent runs
+func (c *containerized) verificationConnection() string {
+	if c.CallingContext != nil && c.CallingContext.Kind == resources.NetworkAccessContainer {
+		return c.containerConnection
+	}
+	return c.nativeConnection
+}
+
+// open the database from the agent
+func (c *containerized) open() (*sql.DB, error) {
+	db, err := sql.Open("postgres", c.verificationConnection())
+	if err != nil {
+		return nil, c.w.Wrapf(err, "cannot open database")
+	}
+	return db, nil
+}
+
+// ping the database before starting a container: fail early
+func (c *containerized) ping(ctx context.Context) error {
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = db.PingContext(ctx); err != nil {
+		return c.w.Wrapf(err, "cannot reach database")
+	}
+	return nil
+}
+
+// verifyApply runs the verification query from the agent
+func (c *containerized) verifyApply(ctx context.Context) error {
+	if c.VerificationQuery == "" {
+		return nil
+	}
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return c.verify(ctx, c.w, db)
+}
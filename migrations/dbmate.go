@@ -0,0 +1,260 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+
+	"github.com/codefly-dev/core/resources"
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/lib/pq"
+)
+
+// DbmateImage is the upstream dbmate image: dbmate is its entrypoint
+var DbmateImage = &resources.DockerImage{Repository: "ghcr.io/amacneil", Name: "dbmate", Tag: "2.19.0"}
+
+// dbmateMigrationDir is where the migrations are mounted in the dbmate container
+const dbmateMigrationDir = "/db/migrations"
+
+// dbmateMigrationsTable is the default table of dbmate
+const dbmateMigrationsTable = "schema_migrations"
+
+// Dbmate applies migrations with dbmate in a one-shot Docker container
+type Dbmate struct {
+	containerized
+}
+
+var _ Manager = &Dbmate{}
+
+func NewDbmate(ctx context.Context, conf *Config) *Dbmate {
+	return &Dbmate{
+		containerized: containerized{
+			Config: conf,
+			w:      wool.Get(ctx).In("migrations.Dbmate"),
+		},
+	}
+}
+
+// hasMigrations is false when there are no migration files
+func (d *Dbmate) hasMigrations(ctx context.Context) (bool, error) {
+	return hasMigrations(ctx, d.w, d.MigrationDir, ".sql")
+}
+
+// environment of dbmate: lib/pq reads the session options from PGOPTIONS, unless the URL has its own
+func (d *Dbmate) environment() []string {
+	connection := d.containerConnection
+	if u, err := url.Parse(connection); err == nil && u.Query().Has("options") {
+		if withOptions, err := d.withPGOptions(connection); err == nil {
+			connection = withOptions
+		}
+	}
+	env := []string{fmt.Sprintf("DATABASE_URL=%s", connection)}
+	if d.PGOptions != "" && connection == d.containerConnection {
+		env = append(env, fmt.Sprintf("PGOPTIONS=%s", d.PGOptions))
+	}
+	return env
+}
+
+// run one dbmate command in a container which is removed once done
+func (d *Dbmate) run(ctx context.Context, command string) error {
+	err := oneshot.Run(ctx, &oneshot.Container{
+		Name:      dbmateContainer(d.Unique),
+		Image:     d.image(DbmateImage),
+		Cmd:       []string{"--migrations-dir", dbmateMigrationDir, "--migrations-table", d.migrationsTable(dbmateMigrationsTable), "--no-dump-schema", command},
+		Env:       d.environment(),
+		Network:   d.DockerNetwork,
+		Resources: d.Resources,
+		Mounts: []mount.Mount{
+			{Type: mount.TypeBind, Source: d.MigrationDir, Target: dbmateMigrationDir, ReadOnly: true},
+		},
+	})
+	if err != nil {
+		return d.w.Wrapf(err, "cannot run dbmate %s", command)
+	}
+	return nil
+}
+
+// Current is true when every migration file is recorded by dbmate: no container is needed to find out
+func (d *Dbmate) Current(ctx context.Context) (bool, error) {
+	versions, err := migrationVersions(d.MigrationDir, ".sql")
+	if err != nil {
+		return false, d.w.Wrapf(err, "cannot list migrations")
+	}
+	if len(versions) == 0 {
+		return true, nil
+	}
+	applied, err := d.applied(ctx)
+	if err != nil {
+		// Nothing applied yet or database not reachable: Apply will tell
+		d.w.Debug("cannot read migration versions", wool.ErrField(err))
+		return false, nil
+	}
+	for _, version := range versions {
+		if !applied[version] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// dbmateFile is the VERSION_name.sql convention
+var dbmateFile = regexp.MustCompile(`^\d+_.+\.sql$`)
+
+func (d *Dbmate) Accepts(file string) bool {
+	return dbmateFile.MatchString(filepath.Base(file))
+}
+
+// applied lists the versions recorded by dbmate
+func (d *Dbmate) applied(ctx context.Context) (map[string]bool, error) {
+	db, err := d.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version FROM %s", pq.QuoteIdentifier(d.migrationsTable(dbmateMigrationsTable))))
+	if err != nil {
+		return nil, d.w.Wrapf(err, "cannot query migration versions")
+	}
+	defer rows.Close()
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var version string
+		if err = rows.Scan(&version); err != nil {
+			return nil, d.w.Wrapf(err, "cannot read migration version")
+		}
+		applied[version] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, d.w.Wrapf(err, "cannot read migration versions")
+	}
+	return applied, nil
+}
+
+// History of the versions recorded by dbmate: it doesn't record when they were applied
+func (d *Dbmate) History(ctx context.Context) ([]MigrationRecord, error) {
+	db, err := d.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	exists, err := tableExists(ctx, db, d.migrationsTable(dbmateMigrationsTable), "")
+	if err != nil {
+		return nil, d.w.Wrapf(err, "cannot check migration table")
+	}
+	if !exists {
+		return nil, nil
+	}
+	applied, err := d.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names, err := migrationNames(d.MigrationDir, ".sql")
+	if err != nil {
+		return nil, d.w.Wrapf(err, "cannot list migrations")
+	}
+	var versions []string
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sortVersions(versions)
+	var records []MigrationRecord
+	for _, version := range versions {
+		// The file of an applied migration may be gone
+		records = append(records, MigrationRecord{Version: version, Name: names[version]})
+	}
+	return records, nil
+}
+
+// Pending compares the migration files with the versions recorded by dbmate
+func (d *Dbmate) Pending(ctx context.Context) ([]string, error) {
+	versions, err := migrationVersions(d.MigrationDir, ".sql")
+	if err != nil {
+		return nil, d.w.Wrapf(err, "cannot list migrations")
+	}
+	records, err := d.History(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pendingVersions(versions, records), nil
+}
+
+func (d *Dbmate) Apply(ctx context.Context) (*ApplyResult, error) {
+	ok, err := d.hasMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return &ApplyResult{}, nil
+	}
+	if err = d.ping(ctx); err != nil {
+		return nil, err
+	}
+	// The table doesn't exist before the first apply
+	before, err := d.applied(ctx)
+	if err != nil {
+		before = map[string]bool{}
+	}
+	if err = d.run(ctx, "up"); err != nil {
+		return nil, err
+	}
+	after, err := d.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.verifyApply(ctx); err != nil {
+		return nil, err
+	}
+	return appliedResult(before, after), nil
+}
+
+// appliedResult counts the versions recorded by the apply: the version is the highest one, by value
+func appliedResult(before, after map[string]bool) *ApplyResult {
+	result := &ApplyResult{}
+	for version := range after {
+		if !before[version] {
+			result.Applied++
+		}
+		if result.Version == "" || versionLess(result.Version, version) {
+			result.Version = version
+		}
+	}
+	return result
+}
+
+func (d *Dbmate) Update(ctx context.Context, file string) error {
+	ok, err := d.hasMigrations(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	if err = d.ping(ctx); err != nil {
+		return err
+	}
+	// dbmate rolls back the latest migration only: down to the changed file, which is simply applied when it never was
+	records, err := d.History(ctx)
+	if err != nil {
+		return err
+	}
+	version := fileVersion(file)
+	var rollbacks int
+	for _, record := range records {
+		if !versionLess(record.Version, version) {
+			rollbacks++
+		}
+	}
+	if rollbacks == 0 {
+		d.w.Info(fmt.Sprintf("applying migration: %v", file))
+		return d.run(ctx, "up")
+	}
+	d.w.Info(fmt.Sprintf("re-applying migration: %v", file))
+	for i := 0; i < rollbacks; i++ {
+		if err = d.run(ctx, "down"); err != nil {
+			return err
+		}
+	}
+	return d.run(ctx, "up")
+}
@@ -0,0 +1,108 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codefly-dev/core/wool"
+)
+
+// alembicLayout is an alembic project: not a format of this service
+const alembicLayout = "alembic"
+
+// layouts counts the migration files of each format: an alembic project is a layout of its own
+func layouts(dir string) (map[string]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "alembic.ini" || (entry.IsDir() && name == "versions") {
+			counts[alembicLayout]++
+			continue
+		}
+		if entry.IsDir() {
+			continue
+		}
+		// golang-migrate files are also dbmate ones: they are checked first
+		switch {
+		case golangMigrateFile.MatchString(name):
+			counts[GolangMigrateFormat]++
+		case flywayFile.MatchString(name):
+			counts[FlywayFormat]++
+		case dbmateFile.MatchString(name):
+			counts[DbmateFormat]++
+		}
+	}
+	return counts, nil
+}
+
+// DetectFormat guesses the format from the layout of the migration directory:
+// empty when there are no migrations or files of several formats
+func DetectFormat(dir string) (string, error) {
+	counts, err := layouts(dir)
+	if err != nil {
+		return "", err
+	}
+	if counts[alembicLayout] > 0 {
+		return alembicLayout, nil
+	}
+	if len(counts) != 1 {
+		return "", nil
+	}
+	for format := range counts {
+		return format, nil
+	}
+	return "", nil
+}
+
+// autoFormat is the only format of the migration directory
+func autoFormat(dir string) (string, error) {
+	w := wool.Get(context.Background()).In("migrations.autoFormat", wool.DirField(dir))
+	counts, err := layouts(dir)
+	if err != nil {
+		return "", w.Wrapf(err, "cannot read migration directory")
+	}
+	if counts[alembicLayout] > 0 {
+		return "", w.NewError("migration directory %s is an alembic project: alembic is not supported", dir)
+	}
+	var formats []string
+	for _, format := range []string{GolangMigrateFormat, DbmateFormat, FlywayFormat} {
+		if counts[format] > 0 {
+			formats = append(formats, format)
+		}
+	}
+	switch len(formats) {
+	case 0:
+		return "", w.NewError("cannot detect migration format: no migration files in %s", dir)
+	case 1:
+		return formats[0], nil
+	default:
+		return "", w.NewError("cannot detect migration format: %s has files of %s, set migration-format", dir, strings.Join(formats, " and "))
+	}
+}
+
+// FormatMismatch is an actionable message when the migration directory doesn't look like the format: empty otherwise
+func FormatMismatch(dir string, format string) (string, error) {
+	if format == AutoFormat {
+		return "", nil
+	}
+	if format == "" {
+		format = GolangMigrateFormat
+	}
+	detected, err := DetectFormat(dir)
+	if err != nil || detected == "" || detected == format {
+		return "", err
+	}
+	if detected == alembicLayout {
+		return "migration directory is an alembic project: alembic is not supported, use gomigrate, dbmate or flyway files", nil
+	}
+	return fmt.Sprintf("migration files follow the %s naming but migration-format is %s: set migration-format to %s", detected, format, detected), nil
+}
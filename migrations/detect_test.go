@@ -0,0 +1,89 @@
+package migrations
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatMismatch(t *testing.T) {
+	layouts := map[string][]string{
+		GolangMigrateFormat: {"1_init.up.sql", "1_init.down.sql", "README.md"},
+		DbmateFormat:        {"20240101000000_init.sql"},
+		FlywayFormat:        {"V1__init.sql", "R__views.sql"},
+		alembicLayout:       {"alembic.ini", "env.py"},
+	}
+	for layout, files := range layouts {
+		dir := t.TempDir()
+		for _, file := range files {
+			require.NoError(t, os.WriteFile(path.Join(dir, file), []byte("SELECT 1;"), 0o600))
+		}
+		detected, err := DetectFormat(dir)
+		require.NoError(t, err)
+		require.Equal(t, layout, detected)
+
+		for _, format := range []string{GolangMigrateFormat, DbmateFormat, FlywayFormat} {
+			mismatch, err := FormatMismatch(dir, format)
+			require.NoError(t, err)
+			if format == layout {
+				require.Empty(t, mismatch, layout)
+				continue
+			}
+			require.NotEmpty(t, mismatch, "%s files with %s", layout, format)
+		}
+	}
+
+	// The default format is golang-migrate
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "V1__init.sql"), []byte("SELECT 1;"), 0o600))
+	mismatch, err := FormatMismatch(dir, "")
+	require.NoError(t, err)
+	require.Contains(t, mismatch, "set migration-format to flyway")
+
+	// Nothing to tell without migrations
+	mismatch, err = FormatMismatch(path.Join(dir, "missing"), DbmateFormat)
+	require.NoError(t, err)
+	require.Empty(t, mismatch)
+}
+
+func TestAutoFormat(t *testing.T) {
+	ctx := context.Background()
+	fixture := func(files ...string) string {
+		dir := t.TempDir()
+		for _, file := range files {
+			require.NoError(t, os.WriteFile(path.Join(dir, file), []byte("SELECT 1;"), 0o600))
+		}
+		return dir
+	}
+
+	for format, dir := range map[string]string{
+		GolangMigrateFormat: fixture("1_init.up.sql", "1_init.down.sql", "2_users.up.sql"),
+		DbmateFormat:        fixture("20240101000000_init.sql", "20240102000000_users.sql"),
+		FlywayFormat:        fixture("V1__init.sql", "V1_1__users.sql", "R__views.sql"),
+	} {
+		detected, err := autoFormat(dir)
+		require.NoError(t, err)
+		require.Equal(t, format, detected)
+
+		manager, err := NewManager(ctx, AutoFormat, &Config{MigrationDir: dir})
+		require.NoError(t, err)
+		require.NotNil(t, manager)
+	}
+
+	_, err := autoFormat(fixture())
+	require.ErrorContains(t, err, "no migration files")
+
+	_, err = autoFormat(fixture("1_init.up.sql", "V2__users.sql"))
+	require.ErrorContains(t, err, "gomigrate and flyway")
+
+	_, err = autoFormat(fixture("alembic.ini"))
+	require.ErrorContains(t, err, "alembic")
+
+	// Files of several formats: no mismatch to tell
+	detected, err := DetectFormat(fixture("1_init.up.sql", "V2__users.sql"))
+	require.NoError(t, err)
+	require.Empty(t, detected)
+}
@@ -0,0 +1,327 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	basev0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
+	"github.com/codefly-dev/core/resources"
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/lib/pq"
+)
+
+// FlywayImage is the upstream flyway image: flyway is its entrypoint
+var FlywayImage = &resources.DockerImage{Name: "flyway/flyway", Tag: "10.17.0"}
+
+// flywayMigrationDir is where the migrations are mounted in the flyway container
+const flywayMigrationDir = "/flyway/sql"
+
+// flywayMigrationsTable is the default table of flyway
+const flywayMigrationsTable = "flyway_schema_history"
+
+// flywayFile is the V<version>__<description>.sql convention, R__ for repeatable migrations
+var flywayFile = regexp.MustCompile(`^(V\d+([._]\d+)*|R)__.+\.sql$`)
+
+// Flyway applies migrations with flyway in a one-shot Docker container
+type Flyway struct {
+	containerized
+}
+
+var _ Manager = &Flyway{}
+
+func NewFlyway(ctx context.Context, conf *Config) *Flyway {
+	return &Flyway{
+		containerized: containerized{
+			Config: conf,
+			w:      wool.Get(ctx).In("migrations.Flyway"),
+		},
+	}
+}
+
+// Init checks the target version is a versioned migration
+func (f *Flyway) Init(ctx context.Context, configurations []*basev0.Configuration) error {
+	if err := f.containerized.Init(ctx, configurations); err != nil {
+		return err
+	}
+	if f.TargetVersion == "" {
+		return nil
+	}
+	versions, _, err := f.versions()
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version == f.TargetVersion {
+			return nil
+		}
+	}
+	return f.w.NewError("target version %s is not a migration of %s: available versions are %s", f.TargetVersion, f.MigrationDir, strings.Join(versions, ", "))
+}
+
+func (f *Flyway) Accepts(file string) bool {
+	return flywayFile.MatchString(filepath.Base(file))
+}
+
+// hasMigrations is false when there are no migration files
+func (f *Flyway) hasMigrations(ctx context.Context) (bool, error) {
+	return hasMigrations(ctx, f.w, f.MigrationDir, ".sql")
+}
+
+// command line of flyway: migrate stops at the target version
+func (f *Flyway) command(command string) []string {
+	cmd := []string{
+		fmt.Sprintf("-locations=filesystem:%s", flywayMigrationDir),
+		fmt.Sprintf("-table=%s", f.migrationsTable(flywayMigrationsTable)),
+	}
+	if command == "migrate" && f.TargetVersion != "" {
+		cmd = append(cmd, fmt.Sprintf("-target=%s", f.TargetVersion))
+	}
+	return append(cmd, command)
+}
+
+// run one flyway command in a container which is removed once done
+func (f *Flyway) run(ctx context.Context, command string) error {
+	// The JDBC driver ignores PGOPTIONS: the options go in the URL
+	connection, err := f.withPGOptions(f.containerConnection)
+	if err != nil {
+		return f.w.Wrapf(err, "cannot add session options")
+	}
+	env, err := f.JDBCEnvironment(connection)
+	if err != nil {
+		return err
+	}
+	err = oneshot.Run(ctx, &oneshot.Container{
+		Name:      flywayContainer(f.Unique),
+		Image:     f.image(FlywayImage),
+		Cmd:       f.command(command),
+		Env:       env,
+		Network:   f.DockerNetwork,
+		Resources: f.Resources,
+		Mounts: []mount.Mount{
+			{Type: mount.TypeBind, Source: f.MigrationDir, Target: flywayMigrationDir, ReadOnly: true},
+		},
+	})
+	if err != nil {
+		return f.w.Wrapf(err, "cannot run flyway %s", command)
+	}
+	return nil
+}
+
+// versions of the versioned migration files: repeatable ones have none
+func (f *Flyway) versions() ([]string, bool, error) {
+	entries, err := os.ReadDir(f.MigrationDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, f.w.Wrapf(err, "cannot list migrations")
+	}
+	var versions []string
+	repeatable := false
+	for _, entry := range entries {
+		if entry.IsDir() || !f.Accepts(entry.Name()) {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), "R__") {
+			repeatable = true
+			continue
+		}
+		version, _, _ := strings.Cut(strings.TrimPrefix(entry.Name(), "V"), "__")
+		versions = append(versions, strings.ReplaceAll(version, "_", "."))
+	}
+	return versions, repeatable, nil
+}
+
+// Current is true when every versioned migration, or the target one, is recorded by flyway:
+// repeatable migrations are re-applied on change, only flyway can tell
+func (f *Flyway) Current(ctx context.Context) (bool, error) {
+	versions, repeatable, err := f.versions()
+	if err != nil {
+		return false, err
+	}
+	if repeatable {
+		return false, nil
+	}
+	if len(versions) == 0 {
+		return true, nil
+	}
+	if f.TargetVersion != "" {
+		versions = []string{f.TargetVersion}
+	}
+	applied, err := f.applied(ctx)
+	if err != nil {
+		// Nothing applied yet or database not reachable: Apply will tell
+		f.w.Debug("cannot read migration versions", wool.ErrField(err))
+		return false, nil
+	}
+	recorded := make(map[string]bool)
+	for _, version := range applied {
+		recorded[version] = true
+	}
+	for _, version := range versions {
+		if !recorded[version] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// History of the successful versioned migrations recorded by flyway, with their installation time
+func (f *Flyway) History(ctx context.Context) ([]MigrationRecord, error) {
+	db, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	table := f.migrationsTable(flywayMigrationsTable)
+	exists, err := tableExists(ctx, db, table, "")
+	if err != nil {
+		return nil, f.w.Wrapf(err, "cannot check migration table")
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	query := fmt.Sprintf("SELECT version, description, installed_on FROM %s WHERE success AND version IS NOT NULL ORDER BY installed_rank", pq.QuoteIdentifier(table))
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, f.w.Wrapf(err, "cannot query migration history")
+	}
+	defer rows.Close()
+	var records []MigrationRecord
+	for rows.Next() {
+		var record MigrationRecord
+		var installedOn time.Time
+		if err = rows.Scan(&record.Version, &record.Name, &installedOn); err != nil {
+			return nil, f.w.Wrapf(err, "cannot read migration history")
+		}
+		record.AppliedAt = &installedOn
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, f.w.Wrapf(err, "cannot read migration history")
+	}
+	return records, nil
+}
+
+// applied lists the versions recorded by flyway in order
+func (f *Flyway) applied(ctx context.Context) ([]string, error) {
+	db, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	query := fmt.Sprintf("SELECT version FROM %s WHERE success AND version IS NOT NULL ORDER BY installed_rank", pq.QuoteIdentifier(f.migrationsTable(flywayMigrationsTable)))
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, f.w.Wrapf(err, "cannot query migration versions")
+	}
+	defer rows.Close()
+	var applied []string
+	for rows.Next() {
+		var version string
+		if err = rows.Scan(&version); err != nil {
+			return nil, f.w.Wrapf(err, "cannot read migration version")
+		}
+		applied = append(applied, version)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, f.w.Wrapf(err, "cannot read migration versions")
+	}
+	return applied, nil
+}
+
+// Pending compares the versioned migrations with the successful ones recorded by flyway:
+// repeatable migrations have no version
+func (f *Flyway) Pending(ctx context.Context) ([]string, error) {
+	versions, _, err := f.versions()
+	if err != nil {
+		return nil, err
+	}
+	records, err := f.History(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pendingVersions(versions, records), nil
+}
+
+func (f *Flyway) Apply(ctx context.Context) (*ApplyResult, error) {
+	ok, err := f.hasMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return &ApplyResult{}, nil
+	}
+	if err = f.ping(ctx); err != nil {
+		return nil, err
+	}
+	// The history table doesn't exist before the first apply
+	before, _ := f.applied(ctx)
+	if err = f.run(ctx, "migrate"); err != nil {
+		return nil, err
+	}
+	after, err := f.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.verifyApply(ctx); err != nil {
+		return nil, err
+	}
+	result := &ApplyResult{Applied: len(after) - len(before)}
+	if len(after) > 0 {
+		result.Version = after[len(after)-1]
+	}
+	return result, nil
+}
+
+// Update repairs the history, so a changed migration passes validation, and migrates
+func (f *Flyway) Update(ctx context.Context, file string) error {
+	ok, err := f.hasMigrations(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	if err = f.ping(ctx); err != nil {
+		return err
+	}
+	f.w.Info(fmt.Sprintf("re-applying migration: %v", file))
+	if err = f.run(ctx, "repair"); err != nil {
+		return err
+	}
+	return f.run(ctx, "migrate")
+}
+
+// JDBCEnvironment converts a postgresql:// connection string to the flyway url, user and password:
+// as environment variables, the password doesn't show in the command of an error
+func (f *Flyway) JDBCEnvironment(connection string) ([]string, error) {
+	u, err := url.Parse(connection)
+	if err != nil {
+		return nil, f.w.Wrapf(err, "cannot parse connection string")
+	}
+	if u.Scheme != "postgresql" && u.Scheme != "postgres" {
+		return nil, f.w.NewError("not a postgresql connection string: %s", u.Scheme)
+	}
+	jdbc := url.URL{
+		Scheme:   "jdbc:postgresql",
+		Host:     u.Host,
+		Path:     u.Path,
+		RawQuery: u.RawQuery,
+	}
+	env := []string{fmt.Sprintf("FLYWAY_URL=%s", jdbc.String())}
+	if u.User != nil {
+		env = append(env, fmt.Sprintf("FLYWAY_USER=%s", u.User.Username()))
+		if password, ok := u.User.Password(); ok {
+			env = append(env, fmt.Sprintf("FLYWAY_PASSWORD=%s", password))
+		}
+	}
+	return env, nil
+}
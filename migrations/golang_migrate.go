@@ -0,0 +1,735 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	basev0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/lib/pq"
+)
+
+// GolangMigrate applies migrations with golang-migrate from the agent process
+type GolangMigrate struct {
+	*Config
+	w *wool.Wool
+}
+
+var _ Manager = &GolangMigrate{}
+var _ IdempotencyVerifier = &GolangMigrate{}
+
+func NewGolangMigrate(ctx context.Context, conf *Config) *GolangMigrate {
+	return &GolangMigrate{
+		Config: conf,
+		w:      wool.Get(ctx).In("migrations.GolangMigrate"),
+	}
+}
+
+// golangMigrateFile is the NNNN_name.up.sql / NNNN_name.down.sql convention
+var golangMigrateFile = regexp.MustCompile(`^\d+_[^.]+\.(up|down)\.sql$`)
+
+// Init checks the naming of the migration files and the target version
+func (g *GolangMigrate) Init(_ context.Context, _ []*basev0.Configuration) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	_, err := g.target()
+	return err
+}
+
+// target is the version of the target migration: 0 without a target
+func (g *GolangMigrate) target() (uint64, error) {
+	if g.TargetVersion == "" {
+		return 0, nil
+	}
+	target, err := strconv.ParseUint(g.TargetVersion, 10, 64)
+	if err != nil {
+		return 0, g.w.NewError("target version must be the number of a migration: %s", g.TargetVersion)
+	}
+	versions, err := migrationVersions(g.MigrationDir, ".up.sql")
+	if err != nil {
+		return 0, g.w.Wrapf(err, "cannot list migrations")
+	}
+	for _, v := range versions {
+		// 0002 is version 2
+		if version, err := strconv.ParseUint(v, 10, 64); err == nil && version == target {
+			return target, nil
+		}
+	}
+	return 0, g.w.NewError("target version %s is not a migration of %s: available versions are %s", g.TargetVersion, g.MigrationDir, strings.Join(versions, ", "))
+}
+
+func (g *GolangMigrate) Accepts(file string) bool {
+	return golangMigrateFile.MatchString(filepath.Base(file))
+}
+
+// validate lists the .sql files not following the golang-migrate convention
+func (g *GolangMigrate) validate() error {
+	entries, err := os.ReadDir(g.MigrationDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return g.w.Wrapf(err, "cannot read migration directory")
+	}
+	var invalid []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		if !g.Accepts(entry.Name()) {
+			invalid = append(invalid, entry.Name())
+		}
+	}
+	if len(invalid) > 0 {
+		return g.w.NewError("migration files must be named NNNN_name.up.sql or NNNN_name.down.sql: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// migrationPath returns the source of the migrations: empty when there is nothing to apply
+func (g *GolangMigrate) migrationPath(ctx context.Context) (string, error) {
+	ok, err := hasMigrations(ctx, g.w, g.MigrationDir, ".up.sql")
+	if err != nil || !ok {
+		return "", err
+	}
+	u := url.URL{
+		Scheme: "file",
+		Path:   g.MigrationDir,
+	}
+	return u.String(), nil
+}
+
+// head is the target version or the latest migration version: 0 when there is none
+func (g *GolangMigrate) head() (uint64, error) {
+	if g.TargetVersion != "" {
+		return g.target()
+	}
+	versions, err := migrationVersions(g.MigrationDir, ".up.sql")
+	if err != nil {
+		return 0, g.w.Wrapf(err, "cannot list migrations")
+	}
+	var head uint64
+	for _, v := range versions {
+		version, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, g.w.Wrapf(err, "cannot parse migration version: %s", v)
+		}
+		if version > head {
+			head = version
+		}
+	}
+	return head, nil
+}
+
+// Current compares the version recorded by golang-migrate with the latest migration
+func (g *GolangMigrate) Current(ctx context.Context) (bool, error) {
+	head, err := g.head()
+	if err != nil {
+		return false, err
+	}
+	if head == 0 {
+		return true, nil
+	}
+	connection, err := g.migrationConnection()
+	if err != nil {
+		return false, g.w.Wrapf(err, "cannot create migration connection string")
+	}
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return false, g.w.Wrapf(err, "cannot open database")
+	}
+	defer db.Close()
+
+	var version uint64
+	var dirty bool
+	query := fmt.Sprintf("SELECT version, dirty FROM %s LIMIT 1", pq.QuoteIdentifier(g.migrationsTable(postgres.DefaultMigrationsTable)))
+	err = db.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		// Nothing applied yet or database not reachable: Apply will tell
+		g.w.Debug("cannot read migration version", wool.ErrField(err))
+		return false, nil
+	}
+	return !dirty && version == head, nil
+}
+
+// Pending compares the migration files with the synthesized history
+func (g *GolangMigrate) Pending(ctx context.Context) ([]string, error) {
+	versions, err := migrationVersions(g.MigrationDir, ".up.sql")
+	if err != nil {
+		return nil, g.w.Wrapf(err, "cannot list migrations")
+	}
+	records, err := g.History(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pendingVersions(versions, records), nil
+}
+
+// History is synthesized from the migration files up to the applied version: golang-migrate only records the current one
+func (g *GolangMigrate) History(ctx context.Context) ([]MigrationRecord, error) {
+	connection, err := g.migrationConnection()
+	if err != nil {
+		return nil, g.w.Wrapf(err, "cannot create migration connection string")
+	}
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return nil, g.w.Wrapf(err, "cannot open database")
+	}
+	defer db.Close()
+
+	table := g.migrationsTable(postgres.DefaultMigrationsTable)
+	exists, err := tableExists(ctx, db, table, g.Schema)
+	if err != nil {
+		return nil, g.w.Wrapf(err, "cannot check migration table")
+	}
+	if !exists {
+		return nil, nil
+	}
+	var current uint64
+	var dirty bool
+	err = db.QueryRowContext(ctx, fmt.Sprintf("SELECT version, dirty FROM %s LIMIT 1", pq.QuoteIdentifier(table))).Scan(&current, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, g.w.Wrapf(err, "cannot read migration version")
+	}
+
+	names, err := migrationNames(g.MigrationDir, ".up.sql")
+	if err != nil {
+		return nil, g.w.Wrapf(err, "cannot list migrations")
+	}
+	var versions []string
+	for v := range names {
+		version, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, g.w.Wrapf(err, "cannot parse migration version: %s", v)
+		}
+		// A dirty version failed midway
+		if version < current || (version == current && !dirty) {
+			versions = append(versions, v)
+		}
+	}
+	sortVersions(versions)
+	var records []MigrationRecord
+	for _, version := range versions {
+		records = append(records, MigrationRecord{Version: version, Name: names[version]})
+	}
+	return records, nil
+}
+
+func (g *GolangMigrate) Apply(ctx context.Context) (*ApplyResult, error) {
+	// Check if we have migrations to apply
+	migrationPath, err := g.migrationPath(ctx)
+	if err != nil {
+		return nil, g.w.Wrapf(err, "can check migration directory")
+	}
+	if migrationPath == "" {
+		return &ApplyResult{}, nil
+	}
+
+	connection, err := g.migrationConnection()
+	if err != nil {
+		return nil, g.w.Wrapf(err, "cannot create migration connection string")
+	}
+	g.w.Debug("migrations", wool.Field("connection", MaskConnectionString(connection)))
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return nil, g.w.Wrapf(err, "cannot open database")
+	}
+	defer db.Close()
+
+	driver, err := g.driver(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := migrate.NewWithDatabaseInstance(
+		migrationPath,
+		g.DatabaseName, driver)
+	if err != nil {
+		_ = driver.Close()
+		return nil, g.w.Wrapf(err, "cannot create migration")
+	}
+	defer m.Close()
+	tail := oneshot.NewTail(oneshot.DefaultTailLines)
+	m.Log = g.logger(tail)
+
+	if err = g.recoverDirty(m); err != nil {
+		return nil, err
+	}
+
+	before, err := g.version(m)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop between two migrations once the context is done
+	stop := context.AfterFunc(ctx, func() {
+		m.GracefulStop <- true
+	})
+	defer stop()
+
+	if err := g.migrate(m); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return nil, g.w.Wrapf(err, "can't apply migration%s", tail.Suffix())
+	}
+	if ctx.Err() != nil {
+		return nil, g.w.Wrapf(ctx.Err(), "migration interrupted")
+	}
+
+	after, err := g.version(m)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := g.countBetween(before, after)
+	if err != nil {
+		return nil, err
+	}
+	if err = g.verify(ctx, g.w, db); err != nil {
+		return nil, err
+	}
+	result := &ApplyResult{Applied: applied}
+	if after > 0 {
+		result.Version = strconv.FormatUint(after, 10)
+	}
+	return result, nil
+}
+
+// migrate up to the latest migration or to the target version, down when the database is past it
+func (g *GolangMigrate) migrate(m *migrate.Migrate) error {
+	target, err := g.target()
+	if err != nil {
+		return err
+	}
+	if target == 0 {
+		return m.Up()
+	}
+	return m.Migrate(uint(target))
+}
+
+// version recorded by golang-migrate: 0 when nothing was applied
+func (g *GolangMigrate) version(m *migrate.Migrate) (uint64, error) {
+	version, _, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, g.w.Wrapf(err, "cannot get migration version")
+	}
+	return uint64(version), nil
+}
+
+// recoverDirty forces a dirty version back to the previous migration so that the failed one runs again:
+// golang-migrate refuses to run on a dirty database
+func (g *GolangMigrate) recoverDirty(m *migrate.Migrate) error {
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return nil
+	}
+	if err != nil {
+		return g.w.Wrapf(err, "cannot get migration version")
+	}
+	if !dirty {
+		return nil
+	}
+	if !g.AutoRecoverDirty {
+		return g.w.NewError("database is dirty at version %d: a migration failed midway. "+
+			"Revert its partial changes then set auto-recover-dirty to run it again, "+
+			"or force the clean version with: migrate -path %s -database <connection> force <version>", version, g.MigrationDir)
+	}
+	clean, err := g.previousVersion(uint64(version))
+	if err != nil {
+		return err
+	}
+	g.w.Warn(fmt.Sprintf("database is dirty at version %d: forcing version %d to run the failed migration again", version, clean),
+		wool.Field("dirty", version), wool.Field("clean", clean))
+	target := int(clean)
+	if clean == 0 {
+		target = database.NilVersion
+	}
+	if err = m.Force(target); err != nil {
+		return g.w.Wrapf(err, "cannot force clean version %d", clean)
+	}
+	return nil
+}
+
+// previousVersion is the latest migration before the version: 0 when there is none
+func (g *GolangMigrate) previousVersion(version uint64) (uint64, error) {
+	versions, err := migrationVersions(g.MigrationDir, ".up.sql")
+	if err != nil {
+		return 0, g.w.Wrapf(err, "cannot list migrations")
+	}
+	var previous uint64
+	for _, v := range versions {
+		candidate, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, g.w.Wrapf(err, "cannot parse migration version: %s", v)
+		}
+		if candidate < version && candidate > previous {
+			previous = candidate
+		}
+	}
+	return previous, nil
+}
+
+// countBetween counts the migrations in (from, to]
+func (g *GolangMigrate) countBetween(from uint64, to uint64) (int, error) {
+	versions, err := migrationVersions(g.MigrationDir, ".up.sql")
+	if err != nil {
+		return 0, g.w.Wrapf(err, "cannot list migrations")
+	}
+	count := 0
+	for _, v := range versions {
+		version, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, g.w.Wrapf(err, "cannot parse migration version: %s", v)
+		}
+		if version > from && version <= to {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// migrationConnection is the connection of the migration user in the migration schema, with the session options
+func (g *GolangMigrate) migrationConnection() (string, error) {
+	connection, err := g.asMigrationUser(g.Connection)
+	if err != nil {
+		return "", err
+	}
+	connection, err = g.withPGOptions(connection)
+	if err != nil {
+		return "", err
+	}
+	return g.inSchema(connection)
+}
+
+// inSchema makes the schema the search path of the connection: unqualified DDL lands in it
+func (g *GolangMigrate) inSchema(connection string) (string, error) {
+	if g.Schema == "" {
+		return connection, nil
+	}
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("search_path", g.Schema)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// createSchema creates the migration schema when missing
+func (g *GolangMigrate) createSchema(ctx context.Context, db *sql.DB) error {
+	if g.Schema == "" {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", pq.QuoteIdentifier(g.Schema)))
+	if err != nil {
+		return g.w.Wrapf(err, "cannot create schema %s", g.Schema)
+	}
+	return nil
+}
+
+// migrateLogger forwards the golang-migrate logs and keeps the last ones for the errors
+type migrateLogger struct {
+	w    *wool.Wool
+	tail *oneshot.Tail
+}
+
+// migrateFinished is the line golang-migrate logs once a migration ran: "Finished 2/u create_orders (read 1ms, ran 3ms)"
+var migrateFinished = regexp.MustCompile(`^Finished (\d+)/(u|d) (.+) \(read ([^,]+), ran ([^)]+)\)$`)
+
+// migrationRun is one migration run by golang-migrate
+type migrationRun struct {
+	version   string
+	direction string
+	name      string
+	ran       string
+}
+
+// parseMigrationRun is false for the lines not reporting a finished migration
+func parseMigrationRun(line string) (*migrationRun, bool) {
+	match := migrateFinished.FindStringSubmatch(line)
+	if match == nil {
+		return nil, false
+	}
+	run := &migrationRun{version: match[1], direction: "up", name: match[3], ran: match[5]}
+	if match[2] == "d" {
+		run.direction = "down"
+	}
+	return run, true
+}
+
+// Printf logs one structured line per migration run: the rest is debug output
+func (l *migrateLogger) Printf(format string, v ...interface{}) {
+	line := strings.TrimSpace(fmt.Sprintf(format, v...))
+	_, _ = fmt.Fprintln(l.tail, line)
+	run, ok := parseMigrationRun(line)
+	if !ok {
+		l.w.Debug(line)
+		return
+	}
+	l.w.Info("migration ran",
+		wool.Field("version", run.version),
+		wool.Field("direction", run.direction),
+		wool.NameField(run.name),
+		wool.Field("ran", run.ran))
+}
+
+func (l *migrateLogger) Verbose() bool {
+	return true
+}
+
+func (g *GolangMigrate) logger(tail *oneshot.Tail) migrate.Logger {
+	return &migrateLogger{w: g.w, tail: tail}
+}
+
+// driverConfig applies the statement settings to the driver of a database
+func (g *GolangMigrate) driverConfig(ctx context.Context, databaseName string) *postgres.Config {
+	config := &postgres.Config{
+		DatabaseName:          databaseName,
+		MultiStatementEnabled: g.MultiStatementEnabled,
+		MultiStatementMaxSize: g.MultiStatementMaxSize,
+		StatementTimeout:      g.StatementTimeout,
+		MigrationsTable:       g.migrationsTable(postgres.DefaultMigrationsTable),
+		SchemaName:            g.Schema,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// Statements can't outlive the context
+		if remaining := time.Until(deadline); config.StatementTimeout == 0 || remaining < config.StatementTimeout {
+			config.StatementTimeout = remaining
+		}
+	}
+	return config
+}
+
+// driver retries on the same handle until the database accepts connections: other errors fail at once
+func (g *GolangMigrate) driver(ctx context.Context, db *sql.DB) (database.Driver, error) {
+	config := g.driverConfig(ctx, g.DatabaseName)
+	var err error
+	for retry := 0; retry < g.retries(); retry++ {
+		var driver database.Driver
+		err = g.createSchema(ctx, db)
+		if err == nil {
+			driver, err = postgres.WithInstance(db, config)
+		}
+		if err == nil {
+			return driver, nil
+		}
+		if !retryable(err) {
+			return nil, g.w.Wrapf(err, "cannot apply migration")
+		}
+		g.w.Debug("waiting for database", wool.ErrField(err))
+		select {
+		case <-ctx.Done():
+			return nil, g.w.Wrapf(ctx.Err(), "cannot apply migration: database not reachable")
+		case <-time.After(g.retryDelay(retry)):
+		}
+	}
+	if g.ConnectRetries > 0 {
+		return nil, g.w.Wrapf(err, "cannot apply migration: database not reachable after %d attempts", g.ConnectRetries)
+	}
+	return nil, g.w.Wrapf(err, "cannot apply migration: database not reachable after %s", g.timeout())
+}
+
+func (g *GolangMigrate) Update(ctx context.Context, migrationFile string) error {
+	if !g.Accepts(migrationFile) {
+		return g.w.NewError("migration file must be named NNNN_name.up.sql or NNNN_name.down.sql: %s", filepath.Base(migrationFile))
+	}
+	// Extract the migration number
+	base := filepath.Base(migrationFile)
+	g.w.Info(fmt.Sprintf("applying migration: %v", base))
+	_migrationNumber := strings.Split(base, "_")[0]
+	migrationNumber, err := strconv.Atoi(_migrationNumber)
+	if err != nil {
+		return g.w.Wrapf(err, "cannot parse migration number")
+	}
+
+	connection, err := g.migrationConnection()
+	if err != nil {
+		return g.w.Wrapf(err, "cannot create migration connection string")
+	}
+	migrationPath, err := g.migrationPath(ctx)
+	if err != nil {
+		return g.w.Wrapf(err, "cannot get migration path")
+	}
+	if migrationPath == "" {
+		return nil
+	}
+
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return g.w.Wrapf(err, "cannot open database")
+	}
+	defer db.Close()
+	if err = g.createSchema(ctx, db); err != nil {
+		return err
+	}
+	driver, err := postgres.WithInstance(db, g.driverConfig(ctx, g.DatabaseName))
+	if err != nil {
+		return g.w.Wrapf(err, "cannot create driver")
+	}
+
+	m, err := migrate.NewWithDatabaseInstance(
+		migrationPath,
+		g.DatabaseName, driver)
+	if err != nil {
+		_ = driver.Close()
+		return g.w.Wrapf(err, "cannot create migration")
+	}
+	defer m.Close()
+	tail := oneshot.NewTail(oneshot.DefaultTailLines)
+	m.Log = g.logger(tail)
+
+	if err := m.Force(migrationNumber); err != nil {
+		return g.w.Wrapf(err, "cannot force migration")
+	}
+	// Now, re-apply migration by moving down.
+	if err := m.Down(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return g.w.Wrapf(err, "cannot apply migration%s", tail.Suffix())
+	}
+	// Now, re-apply migration by moving up.
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return g.w.Wrapf(err, "cannot apply migration%s", tail.Suffix())
+	}
+	// Optionally, check if there are any errors in the migration process
+	var errMigrate migrate.ErrDirty
+	if errors.As(err, &errMigrate) {
+		return g.w.Wrapf(err, "migration is dirty")
+	}
+	return g.w.Wrapf(err, "migration applied")
+}
+
+// VerifyIdempotent applies all migrations against a shadow database, then applies them again:
+// the second apply must be a no-op and replaying every migration on the migrated schema must not fail
+func (g *GolangMigrate) VerifyIdempotent(ctx context.Context) error {
+	migrationPath, err := g.migrationPath(ctx)
+	if err != nil {
+		return g.w.Wrapf(err, "can check migration directory")
+	}
+	if migrationPath == "" {
+		return nil
+	}
+
+	admin, err := sql.Open("postgres", g.adminConnection())
+	if err != nil {
+		return g.w.Wrapf(err, "cannot open admin database")
+	}
+	defer admin.Close()
+
+	shadow := shadowDatabaseName(g.DatabaseName, time.Now())
+	g.w.Debug("creating shadow database", wool.Field("name", shadow))
+	_, err = admin.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE %s", pq.QuoteIdentifier(shadow)))
+	if err != nil {
+		return g.w.Wrapf(err, "cannot create shadow database")
+	}
+	defer func() {
+		_, err := admin.ExecContext(context.Background(), fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", pq.QuoteIdentifier(shadow)))
+		if err != nil {
+			g.w.Warn("cannot drop shadow database", wool.ErrField(err))
+		}
+	}()
+
+	shadowConnection, err := withDatabase(g.Connection, shadow)
+	if err == nil {
+		shadowConnection, err = g.inSchema(shadowConnection)
+	}
+	if err != nil {
+		return g.w.Wrapf(err, "cannot create shadow connection string")
+	}
+
+	db, err := sql.Open("postgres", shadowConnection)
+	if err != nil {
+		return g.w.Wrapf(err, "cannot open shadow database")
+	}
+	defer db.Close()
+	if err = g.createSchema(ctx, db); err != nil {
+		return err
+	}
+	driver, err := postgres.WithInstance(db, g.driverConfig(ctx, shadow))
+	if err != nil {
+		return g.w.Wrapf(err, "cannot create driver")
+	}
+	m, err := migrate.NewWithDatabaseInstance(migrationPath, shadow, driver)
+	if err != nil {
+		_ = driver.Close()
+		return g.w.Wrapf(err, "cannot create migration")
+	}
+	defer m.Close()
+
+	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return g.w.Wrapf(err, "cannot apply migrations")
+	}
+	version, _, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return g.w.Wrapf(err, "cannot get migration version")
+	}
+
+	// A second apply must not find anything to do
+	if err = m.Up(); !errors.Is(err, migrate.ErrNoChange) {
+		if err == nil {
+			return g.w.NewError("second apply is not a no-op")
+		}
+		return g.w.Wrapf(err, "second apply failed")
+	}
+
+	// Forget about the applied versions so every migration runs again on the migrated schema
+	if err = m.Force(database.NilVersion); err != nil {
+		return g.w.Wrapf(err, "cannot reset migration version")
+	}
+	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return g.w.Wrapf(err, "migrations are not idempotent")
+	}
+	again, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return g.w.Wrapf(err, "cannot get migration version")
+	}
+	if dirty || again != version {
+		return g.w.NewError("migrations are not idempotent: version %d (dirty: %v) after replay, expected %d", again, dirty, version)
+	}
+	g.w.Debug("migrations are idempotent", wool.Field("version", version))
+	return nil
+}
+
+// maxIdentifierLength is the number of bytes Postgres keeps from an identifier
+const maxIdentifierLength = 63
+
+// shadowDatabaseName derives a unique database name that Postgres won't truncate
+func shadowDatabaseName(name string, now time.Time) string {
+	suffix := fmt.Sprintf("_shadow_%d", now.UnixMilli())
+	if len(name)+len(suffix) > maxIdentifierLength {
+		name = name[:maxIdentifierLength-len(suffix)]
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+	return name + suffix
+}
+
+// withDatabase returns the connection string targeting another database
+func withDatabase(connection string, name string) (string, error) {
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/" + name
+	return u.String(), nil
+}
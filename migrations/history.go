@@ -0,0 +1,123 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MigrationRecord is one applied migration: AppliedAt is nil when the format doesn't record it
+type MigrationRecord struct {
+	Version   string
+	Name      string
+	AppliedAt *time.Time
+}
+
+// tableExists is false on a database never migrated
+func tableExists(ctx context.Context, db *sql.DB, table string, schema string) (bool, error) {
+	name := pq.QuoteIdentifier(table)
+	if schema != "" {
+		name = pq.QuoteIdentifier(schema) + "." + name
+	}
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists)
+	return exists, err
+}
+
+// migrationNames maps the version of each VERSION_name<suffix> file to its name
+func migrationNames(dir string, suffix string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+		version, name, _ := strings.Cut(strings.TrimSuffix(entry.Name(), suffix), "_")
+		names[version] = name
+	}
+	return names, nil
+}
+
+// versionLess compares numeric versions by value, others as strings
+func versionLess(v, other string) bool {
+	a, errA := strconv.ParseUint(v, 10, 64)
+	b, errB := strconv.ParseUint(other, 10, 64)
+	if errA != nil || errB != nil {
+		return v < other
+	}
+	return a < b
+}
+
+// sortVersions orders numeric versions by value: "10" comes after "9"
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		return versionLess(versions[i], versions[j])
+	})
+}
+
+// pendingVersions are the versions on disk without a record, in order
+func pendingVersions(versions []string, records []MigrationRecord) []string {
+	applied := make(map[string]bool)
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+	var pending []string
+	for _, version := range versions {
+		if !applied[version] {
+			pending = append(pending, version)
+		}
+	}
+	sortVersions(pending)
+	return pending
+}
+
+// fileVersion is the version of a migration file: 0002_users.up.sql is 0002 and V1_1__users.sql is 1.1,
+// a flyway repeatable migration has none
+func fileVersion(file string) string {
+	base := filepath.Base(file)
+	if flywayFile.MatchString(base) {
+		if strings.HasPrefix(base, "R__") {
+			return ""
+		}
+		version, _, _ := strings.Cut(strings.TrimPrefix(base, "V"), "__")
+		return strings.ReplaceAll(version, "_", ".")
+	}
+	version, _, _ := strings.Cut(base, "_")
+	return version
+}
+
+// LatestApplied is the changed file with the highest version in the history:
+// empty when none of them was applied yet
+func LatestApplied(records []MigrationRecord, files []string) string {
+	var latest, latestVersion string
+	for _, file := range files {
+		version := fileVersion(file)
+		if version == "" {
+			continue
+		}
+		for _, record := range records {
+			// golang-migrate records 0002 as 2
+			if record.Version != version && (versionLess(record.Version, version) || versionLess(version, record.Version)) {
+				continue
+			}
+			if latest == "" || versionLess(latestVersion, version) {
+				latest, latestVersion = file, version
+			}
+			break
+		}
+	}
+	return latest
+}
@@ -0,0 +1,483 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	basev0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
+	"github.com/codefly-dev/core/resources"
+	"github.com/codefly-dev/core/shared"
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
+	"github.com/docker/docker/api/types/container"
+	"github.com/lib/pq"
+)
+
+// Supported migration formats
+const (
+	GolangMigrateFormat = "gomigrate"
+	DbmateFormat        = "dbmate"
+	FlywayFormat        = "flyway"
+
+	// AutoFormat picks the format from the files of the migration directory
+	AutoFormat = "auto"
+)
+
+// Config is what a Manager needs to find the migrations and reach the database
+type Config struct {
+	// DatabaseName to migrate
+	DatabaseName string
+
+	// MigrationDir is the absolute path of the migrations
+	MigrationDir string
+
+	// MigrationDirs replaces MigrationDir with absolute paths applied in order, see Sequence
+	MigrationDirs []string
+
+	// Connection string reachable from the agent
+	Connection string
+
+	// AdminConnection to an existing database of the same server: databases are created from it
+	AdminConnection string
+
+	// ContainerConnection reaches the database from the migration containers with the SSL settings of Connection:
+	// read from the runtime configurations when empty
+	ContainerConnection string
+
+	// User and Password of the role running the migrations: the connection user when empty
+	User     string
+	Password string
+
+	// Unique is used to name the containers running migrations
+	Unique string
+
+	// CallingContext is the network access of the agent: it selects the connection used for verifications
+	CallingContext *basev0.NetworkAccess
+
+	// MigrationTimeout bounds how long to wait for the database to accept migrations
+	MigrationTimeout time.Duration
+
+	// ConnectRetries replaces the retries derived from the migration timeout: attempts back off exponentially
+	ConnectRetries int
+
+	// VerificationQuery runs after an apply: it must return a single truthy value
+	VerificationQuery string
+
+	// VerificationTimeout bounds the verification query: DefaultVerificationTimeout when 0
+	VerificationTimeout time.Duration
+
+	// MultiStatementEnabled runs the statements of a golang-migrate migration one by one:
+	// a migration is otherwise sent at once and runs in an implicit transaction
+	MultiStatementEnabled bool
+
+	// MultiStatementMaxSize is the largest migration read in multi-statement mode: 10MB when 0
+	MultiStatementMaxSize int
+
+	// StatementTimeout bounds each golang-migrate statement
+	StatementTimeout time.Duration
+
+	// MigrationsTable records the applied migrations: the default table of the format when empty
+	MigrationsTable string
+
+	// Schema of the golang-migrate migrations and their table, created when missing: the search path when empty
+	Schema string
+
+	// ImageRegistryPrefix is the mirror the migration images are pulled from
+	ImageRegistryPrefix string
+
+	// DockerNetwork the migration containers join: they reach the database on its NetworkAddress
+	DockerNetwork  string
+	NetworkAddress string
+
+	// TargetVersion to migrate to, up or down with golang-migrate: the latest migration when empty
+	TargetVersion string
+
+	// AutoRecoverDirty forces a dirty golang-migrate version back to the last clean one before applying
+	AutoRecoverDirty bool
+
+	// Resources limits the memory and CPU of the migration containers
+	Resources container.Resources
+
+	// PGOptions are session options of the migrations, like "-c lock_timeout=5s"
+	PGOptions string
+}
+
+// migrationsTable is the configured table or the default one of the format
+func (c *Config) migrationsTable(defaultTable string) string {
+	if c.MigrationsTable == "" {
+		return defaultTable
+	}
+	return c.MigrationsTable
+}
+
+// VersionTables are the tables any format records the applied migrations in
+func (c *Config) VersionTables() []string {
+	tables := []string{c.migrationsTable(dbmateMigrationsTable)}
+	if flyway := c.migrationsTable(flywayMigrationsTable); flyway != tables[0] {
+		tables = append(tables, flyway)
+	}
+	return tables
+}
+
+// verify runs the verification query, if any, after an apply
+func (c *Config) verify(ctx context.Context, w *wool.Wool, db *sql.DB) error {
+	if c.VerificationQuery == "" {
+		return nil
+	}
+	timeout := c.VerificationTimeout
+	if timeout == 0 {
+		timeout = DefaultVerificationTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var value any
+	err := db.QueryRowContext(ctx, c.VerificationQuery).Scan(&value)
+	if err != nil {
+		return w.Wrapf(err, "cannot run verification query")
+	}
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	w.Info("verification query", wool.Field("query", c.VerificationQuery), wool.Field("result", value))
+	if !truthy(value) {
+		return w.NewError("migration verification failed: %s returned %v", c.VerificationQuery, value)
+	}
+	return nil
+}
+
+// truthy follows Postgres: false, 0, NULL and the empty string are false
+func truthy(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case []byte:
+		return truthy(string(v))
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "", "0", "f", "false", "n", "no", "off":
+			return false
+		}
+		return true
+	default:
+		return true
+	}
+}
+
+// DefaultVerificationTimeout bounds a verification query stuck behind a lock
+const DefaultVerificationTimeout = 10 * time.Second
+
+// DefaultMigrationTimeout keeps the historical 3 retries, one second apart
+const DefaultMigrationTimeout = 3 * time.Second
+
+// migrationRetryDelay between two attempts to reach the database
+const migrationRetryDelay = time.Second
+
+// asMigrationUser returns the connection string authenticated as the migration user
+func (c *Config) asMigrationUser(connection string) (string, error) {
+	if c.User == "" {
+		return connection, nil
+	}
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(c.User, c.Password)
+	return u.String(), nil
+}
+
+// maskedPassword replaces the password of the logged connection strings
+const maskedPassword = "****"
+
+// keywordPassword is the password of a keyword/value connection string, quoted or not
+var keywordPassword = regexp.MustCompile(`password=('(?:[^'\\]|\\.)*'|\S+)`)
+
+// MaskConnectionString hides the password of a URL or keyword/value connection string: use it to log one
+func MaskConnectionString(connection string) string {
+	if u, err := url.Parse(connection); err == nil && u.Scheme != "" {
+		// url escapes the asterisks: Redacted leaves a placeholder to replace
+		const placeholder = "xxxxx"
+		if u.Query().Has("password") {
+			query := u.Query()
+			query.Set("password", placeholder)
+			u.RawQuery = strings.Replace(query.Encode(), "password="+placeholder, "password="+maskedPassword, 1)
+		}
+		return strings.Replace(u.Redacted(), ":"+placeholder+"@", ":"+maskedPassword+"@", 1)
+	}
+	return keywordPassword.ReplaceAllString(connection, "password="+maskedPassword)
+}
+
+// withPGOptions returns the connection string with the session options of the migrations
+func (c *Config) withPGOptions(connection string) (string, error) {
+	if c.PGOptions == "" {
+		return connection, nil
+	}
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", err
+	}
+	// Keep the options of the connection, like its search path
+	query := u.Query()
+	options := c.PGOptions
+	if existing := query.Get("options"); existing != "" {
+		options = existing + " " + options
+	}
+	query.Set("options", options)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// inNetwork returns the container connection string to the database address inside the docker network
+func (c *Config) inNetwork(connection string) (string, error) {
+	if c.DockerNetwork == "" {
+		return connection, nil
+	}
+	u, err := url.Parse(connection)
+	if err != nil {
+		return "", err
+	}
+	u.Host = c.NetworkAddress
+	return u.String(), nil
+}
+
+// image of a migration container, from the mirror when configured
+func (c *Config) image(image *resources.DockerImage) *resources.DockerImage {
+	return oneshot.WithRegistry(c.ImageRegistryPrefix, image)
+}
+
+// dbmateContainer and flywayContainer name the migration containers of a service
+func dbmateContainer(unique string) string {
+	return fmt.Sprintf("%s-dbmate", unique)
+}
+
+func flywayContainer(unique string) string {
+	return fmt.Sprintf("%s-flyway", unique)
+}
+
+// RunnerContainers are the containers that may run migrations for a service
+func RunnerContainers(unique string) []string {
+	return []string{dbmateContainer(unique), flywayContainer(unique)}
+}
+
+// adminConnection falls back on the connection: only the database it targets must not be the created one
+func (c *Config) adminConnection() string {
+	if c.AdminConnection == "" {
+		return c.Connection
+	}
+	return c.AdminConnection
+}
+
+// Backoff of the connect retries
+const (
+	initialRetryDelay = 250 * time.Millisecond
+	maxRetryDelay     = 4 * time.Second
+)
+
+// retries derived from the migration timeout unless set: at least one attempt is made
+func (c *Config) retries() int {
+	if c.ConnectRetries > 0 {
+		return c.ConnectRetries
+	}
+	timeout := c.timeout()
+	retries := int(timeout / migrationRetryDelay)
+	if retries < 1 {
+		return 1
+	}
+	return retries
+}
+
+// retryDelay before the attempt following the given one
+func (c *Config) retryDelay(attempt int) time.Duration {
+	if c.ConnectRetries <= 0 {
+		return migrationRetryDelay
+	}
+	delay := initialRetryDelay
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// retryable is true for the errors of a database not reachable yet:
+// a rejected password or a broken statement fails the same way on every attempt
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// connection_exception or cannot_connect_now while the server starts
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P03"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, driver.ErrBadConn)
+}
+
+func (c *Config) timeout() time.Duration {
+	if c.MigrationTimeout <= 0 {
+		return DefaultMigrationTimeout
+	}
+	return c.MigrationTimeout
+}
+
+// Manager applies the migrations of one format
+type Manager interface {
+	// Init prepares the manager from the runtime configurations
+	Init(ctx context.Context, configurations []*basev0.Configuration) error
+
+	// Current is true when the database is already at the latest migration
+	Current(ctx context.Context) (bool, error)
+
+	// Apply all pending migrations
+	Apply(ctx context.Context) (*ApplyResult, error)
+
+	// Update re-applies a changed migration file
+	Update(ctx context.Context, file string) error
+
+	// Accepts is true when the file name follows the naming convention of the format
+	Accepts(file string) bool
+
+	// History lists the applied migrations in order: empty on a database never migrated
+	History(ctx context.Context) ([]MigrationRecord, error)
+
+	// Pending lists the versions on disk not applied yet: read-only
+	Pending(ctx context.Context) ([]string, error)
+}
+
+// ApplyResult tells what an Apply did
+type ApplyResult struct {
+	// Applied is the number of migrations applied
+	Applied int
+
+	// Version of the database after the apply: empty when no migration was ever applied
+	Version string
+}
+
+// IdempotencyVerifier is implemented by managers able to replay migrations
+type IdempotencyVerifier interface {
+	VerifyIdempotent(ctx context.Context) error
+}
+
+// WatchPatterns are the migration files of a format to watch for hot-reload
+func WatchPatterns(format string) []string {
+	switch format {
+	case "", GolangMigrateFormat, DbmateFormat, FlywayFormat, AutoFormat:
+		return []string{"*.sql"}
+	default:
+		return nil
+	}
+}
+
+// NewManager returns the Manager for the format: golang-migrate is the default
+func NewManager(ctx context.Context, format string, conf *Config) (Manager, error) {
+	if len(conf.MigrationDirs) > 0 {
+		return newSequence(ctx, format, conf)
+	}
+	switch format {
+	case AutoFormat:
+		detected, err := autoFormat(conf.MigrationDir)
+		if err != nil {
+			return nil, err
+		}
+		wool.Get(ctx).In("migrations.NewManager").Info(fmt.Sprintf("detected migration format: %s", detected))
+		return NewManager(ctx, detected, conf)
+	case "", GolangMigrateFormat:
+		return NewGolangMigrate(ctx, conf), nil
+	case DbmateFormat:
+		if conf.TargetVersion != "" {
+			return nil, wool.Get(ctx).In("migrations.NewManager").NewError("dbmate always migrates to the latest migration: unset the target version")
+		}
+		return NewDbmate(ctx, conf), nil
+	case FlywayFormat:
+		return NewFlyway(ctx, conf), nil
+	default:
+		return nil, wool.Get(ctx).In("migrations.NewManager").NewError("unknown migration format: %s", format)
+	}
+}
+
+// migrationVersions lists the versions of the migration files with the given suffix: nothing if the directory is missing
+func migrationVersions(dir string, suffix string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+		version, _, _ := strings.Cut(entry.Name(), "_")
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// hasMigrations is false when the directory is missing, empty or without migration files
+func hasMigrations(ctx context.Context, w *wool.Wool, dir string, suffix string) (bool, error) {
+	exists, err := shared.DirectoryExists(ctx, dir)
+	if err != nil {
+		return false, w.Wrapf(err, "can check migration directory")
+	}
+	if !exists {
+		w.Debug("no migration folder found: no migrations to apply", wool.DirField(dir))
+		return false, nil
+	}
+	empty, err := shared.CheckEmptyDirectory(ctx, dir)
+	if err != nil {
+		return false, w.Wrapf(err, "can check migration directory")
+	}
+	if empty {
+		w.Debug("migration folder is empty: no migrations to apply", wool.DirField(dir))
+		return false, nil
+	}
+	versions, err := migrationVersions(dir, suffix)
+	if err != nil {
+		return false, w.Wrapf(err, "cannot list migrations")
+	}
+	if len(versions) == 0 {
+		w.Debug("no migration files: no migrations to apply", wool.DirField(dir))
+		return false, nil
+	}
+	return true, nil
+}
+
+// connections extracts the native and container connection strings from the runtime configurations
+func connections(ctx context.Context, configurations []*basev0.Configuration) (string, string, error) {
+	w := wool.Get(ctx).In("migrations.connections")
+	native, err := resources.ExtractConfiguration(configurations, resources.NewRuntimeContextNative())
+	if err != nil {
+		return "", "", w.Wrapf(err, "cannot find native configuration")
+	}
+	nativeConnection, err := resources.GetConfigurationValue(ctx, native, "postgres", "connection")
+	if err != nil {
+		return "", "", w.Wrapf(err, "cannot get native connection")
+	}
+	container, err := resources.ExtractConfiguration(configurations, resources.NewRuntimeContextContainer())
+	if err != nil {
+		return "", "", w.Wrapf(err, "cannot find container configuration")
+	}
+	containerConnection, err := resources.GetConfigurationValue(ctx, container, "postgres", "connection")
+	if err != nil {
+		return "", "", w.Wrapf(err, "cannot get container connection")
+	}
+	return nativeConnection, containerConnection, nil
+}
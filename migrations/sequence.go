@@ -0,0 +1,174 @@
+package migrations
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	basev0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
+	"github.com/codefly-dev/core/wool"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+)
+
+// Sequence applies the migrations of several directories in order: a directory is fully migrated
+// before the next one starts and a failure stops the sequence. dbmate directories share the version
+// table, its versions being independent. golang-migrate and flyway keep a single version line per table:
+// the directories after the first one get their own table, suffixed by the directory name.
+type Sequence struct {
+	*Config
+	format   string
+	configs  []*Config
+	managers []Manager
+	w        *wool.Wool
+}
+
+func newSequence(ctx context.Context, format string, conf *Config) (*Sequence, error) {
+	w := wool.Get(ctx).In("migrations.Sequence")
+	if conf.TargetVersion != "" {
+		return nil, w.NewError("a target version needs a single migration directory")
+	}
+	if format == AutoFormat {
+		detected, err := autoFormat(conf.MigrationDirs[0])
+		if err != nil {
+			return nil, err
+		}
+		w.Info("detected migration format: " + detected)
+		format = detected
+	}
+	if format == "" {
+		format = GolangMigrateFormat
+	}
+	s := &Sequence{Config: conf, format: format, w: w}
+	tables := make(map[string]bool)
+	for i, dir := range conf.MigrationDirs {
+		if i > 0 && format != DbmateFormat {
+			table := s.directoryTable(dir)
+			if tables[table] {
+				return nil, w.NewError("migration directories %s share the version table %s: give them different names", strings.Join(conf.MigrationDirs, ", "), table)
+			}
+			tables[table] = true
+		}
+		s.configs = append(s.configs, &Config{})
+	}
+	s.derive()
+	for _, c := range s.configs {
+		manager, err := NewManager(ctx, format, c)
+		if err != nil {
+			return nil, err
+		}
+		s.managers = append(s.managers, manager)
+	}
+	return s, nil
+}
+
+// derive the configuration of each directory from the shared one, which changes with the credentials
+func (s *Sequence) derive() {
+	for i, c := range s.configs {
+		*c = *s.Config
+		c.MigrationDirs = nil
+		c.MigrationDir = s.MigrationDirs[i]
+		if i > 0 && s.format != DbmateFormat {
+			c.MigrationsTable = s.directoryTable(s.MigrationDirs[i])
+		}
+	}
+}
+
+// directoryTable is the version table of a directory after the first one
+func (s *Sequence) directoryTable(dir string) string {
+	table := postgres.DefaultMigrationsTable
+	if s.format == FlywayFormat {
+		table = flywayMigrationsTable
+	}
+	suffix := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(filepath.Base(dir)))
+	return s.migrationsTable(table) + "_" + suffix
+}
+
+func (s *Sequence) Init(ctx context.Context, configurations []*basev0.Configuration) error {
+	s.derive()
+	for _, manager := range s.managers {
+		if err := manager.Init(ctx, configurations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sequence) Current(ctx context.Context) (bool, error) {
+	for _, manager := range s.managers {
+		current, err := manager.Current(ctx)
+		if err != nil || !current {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Apply the directories in order: the version is the one of the last directory with migrations
+func (s *Sequence) Apply(ctx context.Context) (*ApplyResult, error) {
+	result := &ApplyResult{}
+	for i, manager := range s.managers {
+		applied, err := manager.Apply(ctx)
+		if err != nil {
+			return nil, s.w.Wrapf(err, "cannot apply migrations of %s", s.MigrationDirs[i])
+		}
+		result.Applied += applied.Applied
+		if applied.Version != "" {
+			result.Version = applied.Version
+		}
+	}
+	return result, nil
+}
+
+// Update re-applies the file with the manager of its directory
+func (s *Sequence) Update(ctx context.Context, file string) error {
+	for i, dir := range s.MigrationDirs {
+		if strings.HasPrefix(file, dir+string(filepath.Separator)) {
+			return s.managers[i].Update(ctx, file)
+		}
+	}
+	return s.w.NewError("%s is not in a migration directory", file)
+}
+
+func (s *Sequence) Accepts(file string) bool {
+	return s.managers[0].Accepts(file)
+}
+
+// History of the directories one after the other: the shared dbmate table is read once,
+// each directory naming its own versions
+func (s *Sequence) History(ctx context.Context) ([]MigrationRecord, error) {
+	var history []MigrationRecord
+	for i, manager := range s.managers {
+		records, err := manager.History(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if s.format != DbmateFormat || i == 0 {
+			history = append(history, records...)
+			continue
+		}
+		for j := range history {
+			if history[j].Name == "" && j < len(records) && records[j].Version == history[j].Version {
+				history[j].Name = records[j].Name
+			}
+		}
+	}
+	return history, nil
+}
+
+// Pending versions of the directories in the order they are applied
+func (s *Sequence) Pending(ctx context.Context) ([]string, error) {
+	var pending []string
+	for _, manager := range s.managers {
+		versions, err := manager.Pending(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, versions...)
+	}
+	return pending, nil
+}
@@ -0,0 +1,63 @@
+package migrations
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequenceTables(t *testing.T) {
+	ctx := context.Background()
+	dirs := []string{"/svc/migrations/core", "/svc/migrations/feature-flags"}
+
+	tables := func(s *Sequence) []string {
+		var tables []string
+		for _, c := range s.configs {
+			tables = append(tables, c.migrationsTable(""))
+		}
+		return tables
+	}
+
+	manager, err := NewManager(ctx, GolangMigrateFormat, &Config{MigrationDirs: dirs})
+	require.NoError(t, err)
+	sequence := manager.(*Sequence)
+	require.Equal(t, []string{"", "schema_migrations_feature_flags"}, tables(sequence))
+	require.Equal(t, dirs[1], sequence.configs[1].MigrationDir)
+
+	manager, err = NewManager(ctx, FlywayFormat, &Config{MigrationDirs: dirs, MigrationsTable: "history"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"history", "history_feature_flags"}, tables(manager.(*Sequence)))
+
+	// dbmate versions are independent: the table is shared
+	manager, err = NewManager(ctx, DbmateFormat, &Config{MigrationDirs: dirs})
+	require.NoError(t, err)
+	require.Equal(t, []string{"", ""}, tables(manager.(*Sequence)))
+
+	_, err = NewManager(ctx, GolangMigrateFormat, &Config{MigrationDirs: []string{"/a", "/b/feature", "/c/feature"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "share the version table schema_migrations_feature")
+
+	_, err = NewManager(ctx, GolangMigrateFormat, &Config{MigrationDirs: dirs, TargetVersion: "2"})
+	require.Error(t, err)
+}
+
+func TestSequenceDerive(t *testing.T) {
+	ctx := context.Background()
+	conf := &Config{MigrationDirs: []string{"/svc/core", "/svc/feature"}, Connection: "postgresql://old"}
+	manager, err := NewManager(ctx, GolangMigrateFormat, conf)
+	require.NoError(t, err)
+	sequence := manager.(*Sequence)
+
+	// Rotated credentials reach every directory on Init
+	conf.Connection = "postgresql://new"
+	require.NoError(t, sequence.Init(ctx, nil))
+	for _, c := range sequence.configs {
+		require.Equal(t, "postgresql://new", c.Connection)
+	}
+
+	err = sequence.Update(ctx, filepath.Join("/svc/other", "1_init.up.sql"))
+	require.Error(t, err)
+	require.True(t, sequence.Accepts("1_init.up.sql"))
+}
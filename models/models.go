@@ -0,0 +1,205 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/codefly-dev/core/wool"
+)
+
+// Column of a table as found in information_schema
+type Column struct {
+	Table    string
+	Name     string
+	DataType string
+	Nullable bool
+}
+
+// FileName of the generated models inside the output package
+const FileName = "models.go"
+
+// ignoredTables are bookkeeping tables of the migration tools
+var ignoredTables = map[string]bool{
+	"schema_migrations":     true,
+	"flyway_schema_history": true,
+}
+
+// Introspect the columns of the public schema, without the bookkeeping tables and the ignored ones
+func Introspect(ctx context.Context, db *sql.DB, ignored ...string) ([]Column, error) {
+	w := wool.Get(ctx).In("models.Introspect")
+	rows, err := db.QueryContext(ctx, `SELECT table_name, column_name, data_type, is_nullable
+FROM information_schema.columns
+WHERE table_schema = 'public'
+ORDER BY table_name, ordinal_position`)
+	if err != nil {
+		return nil, w.Wrapf(err, "cannot query information schema")
+	}
+	defer rows.Close()
+
+	var columns []Column
+	for rows.Next() {
+		var column Column
+		var nullable string
+		if err = rows.Scan(&column.Table, &column.Name, &column.DataType, &nullable); err != nil {
+			return nil, w.Wrapf(err, "cannot read column")
+		}
+		if ignoredTables[column.Table] || slices.Contains(ignored, column.Table) {
+			continue
+		}
+		column.Nullable = nullable == "YES"
+		columns = append(columns, column)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, w.Wrapf(err, "cannot read columns")
+	}
+	return columns, nil
+}
+
+// Render the Go source of one struct per table
+func Render(pkg string, columns []Column) ([]byte, error) {
+	tables := make(map[string][]Column)
+	imports := make(map[string]bool)
+	for _, column := range columns {
+		tables[column.Table] = append(tables[column.Table], column)
+		if imp := goImport(column.DataType); imp != "" {
+			imports[imp] = true
+		}
+	}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by codefly from the migrated schema. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	if len(imports) > 0 {
+		buf.WriteString("import (\n")
+		for _, imp := range sortedKeys(imports) {
+			fmt.Fprintf(&buf, "\t%q\n", imp)
+		}
+		buf.WriteString(")\n\n")
+	}
+	for _, name := range names {
+		fmt.Fprintf(&buf, "// %s maps the %s table\n", goName(name), name)
+		fmt.Fprintf(&buf, "type %s struct {\n", goName(name))
+		for _, column := range tables[name] {
+			typ := goType(column.DataType)
+			if column.Nullable && !strings.HasPrefix(typ, "[]") && typ != "json.RawMessage" {
+				typ = "*" + typ
+			}
+			fmt.Fprintf(&buf, "\t%s %s `db:%q`\n", goName(column.Name), typ, column.Name)
+		}
+		buf.WriteString("}\n\n")
+	}
+	return format.Source(buf.Bytes())
+}
+
+// Generate introspects the database and writes the models in the output directory: the package is named after it
+func Generate(ctx context.Context, db *sql.DB, dir string, ignored ...string) error {
+	w := wool.Get(ctx).In("models.Generate", wool.DirField(dir))
+	columns, err := Introspect(ctx, db, ignored...)
+	if err != nil {
+		return err
+	}
+	source, err := Render(packageName(dir), columns)
+	if err != nil {
+		return w.Wrapf(err, "cannot render models")
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return w.Wrapf(err, "cannot create output directory")
+	}
+	if err = os.WriteFile(filepath.Join(dir, FileName), source, 0o644); err != nil {
+		return w.Wrapf(err, "cannot write models")
+	}
+	w.Debug("generated models", wool.Field("columns", len(columns)))
+	return nil
+}
+
+// goType maps a Postgres data type to a Go type
+func goType(dataType string) string {
+	switch dataType {
+	case "smallint":
+		return "int16"
+	case "integer":
+		return "int32"
+	case "bigint":
+		return "int64"
+	case "real":
+		return "float32"
+	case "double precision":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "bytea":
+		return "[]byte"
+	case "json", "jsonb":
+		return "json.RawMessage"
+	case "date", "timestamp without time zone", "timestamp with time zone", "time without time zone", "time with time zone":
+		return "time.Time"
+	default:
+		// text, character varying, uuid, numeric, ...
+		return "string"
+	}
+}
+
+func goImport(dataType string) string {
+	switch goType(dataType) {
+	case "time.Time":
+		return "time"
+	case "json.RawMessage":
+		return "encoding/json"
+	}
+	return ""
+}
+
+// goName converts a snake_case identifier to an exported Go name
+func goName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == ' ' }) {
+		switch strings.ToLower(part) {
+		case "id", "uuid", "url", "json", "sql", "http":
+			b.WriteString(strings.ToUpper(part))
+		default:
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	result := b.String()
+	if result == "" || (result[0] >= '0' && result[0] <= '9') {
+		result = "T" + result
+	}
+	return result
+}
+
+// packageName derives a valid package name from the output directory
+func packageName(dir string) string {
+	name := strings.ToLower(filepath.Base(dir))
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, name)
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return "models"
+	}
+	return name
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
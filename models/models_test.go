@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	columns := []Column{
+		{Table: "user_accounts", Name: "id", DataType: "uuid"},
+		{Table: "user_accounts", Name: "age", DataType: "integer", Nullable: true},
+		{Table: "user_accounts", Name: "created_at", DataType: "timestamp with time zone"},
+		{Table: "user_accounts", Name: "settings", DataType: "jsonb", Nullable: true},
+	}
+	source, err := Render("models", columns)
+	require.NoError(t, err)
+
+	file, err := parser.ParseFile(token.NewFileSet(), "models.go", source, 0)
+	require.NoError(t, err)
+
+	fields := make(map[string]string)
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+		require.Equal(t, "UserAccounts", spec.Name.Name)
+		for _, field := range spec.Type.(*ast.StructType).Fields.List {
+			fields[field.Names[0].Name] = string(source[field.Type.Pos()-1 : field.Type.End()-1])
+		}
+		return false
+	})
+	require.Equal(t, map[string]string{
+		"ID":        "string",
+		"Age":       "*int32",
+		"CreatedAt": "time.Time",
+		"Settings":  "json.RawMessage",
+	}, fields)
+}
+
+func TestPackageName(t *testing.T) {
+	require.Equal(t, "models", packageName("/svc/models"))
+	require.Equal(t, "dbmodels", packageName("/svc/db-models"))
+	require.Equal(t, "models", packageName("/svc/1"))
+}
+
+func TestSchemaWrite(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "schema", "public.json")
+
+	def := "gen_random_uuid()"
+	schema := &Schema{Tables: []*Table{{
+		Schema:  "public",
+		Name:    "orders",
+		Columns: []*TableColumn{{Name: "id", DataType: "uuid", Default: &def}, {Name: "note", DataType: "text", Nullable: true}},
+		Indexes: []*Index{{Name: "orders_pkey", Definition: "CREATE UNIQUE INDEX orders_pkey ON public.orders USING btree (id)"}},
+	}}}
+	require.NoError(t, schema.Write(ctx, file))
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	var read Schema
+	require.NoError(t, json.Unmarshal(content, &read))
+	require.Equal(t, schema, &read)
+
+	// An empty database is still a valid dump
+	require.NoError(t, (&Schema{}).Write(ctx, file))
+	content, err = os.ReadFile(file)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"tables": []}`, string(content))
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/codefly-dev/core/wool"
+)
+
+// Schema is the migrated schema as dumped for drift detection: sorted so dumps diff cleanly
+type Schema struct {
+	Tables []*Table `json:"tables"`
+}
+
+// Table with its columns in definition order and its indexes sorted by name
+type Table struct {
+	Schema  string         `json:"schema"`
+	Name    string         `json:"name"`
+	Columns []*TableColumn `json:"columns"`
+	Indexes []*Index       `json:"indexes"`
+}
+
+type TableColumn struct {
+	Name     string  `json:"name"`
+	DataType string  `json:"data_type"`
+	Nullable bool    `json:"nullable"`
+	Default  *string `json:"default,omitempty"`
+}
+
+type Index struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+// IntrospectSchema reads the tables, columns and indexes of every user schema, without the bookkeeping tables and the ignored ones
+func IntrospectSchema(ctx context.Context, db *sql.DB, ignored ...string) (*Schema, error) {
+	w := wool.Get(ctx).In("models.IntrospectSchema")
+	rows, err := db.QueryContext(ctx, `SELECT c.table_schema, c.table_name, c.column_name, c.data_type, c.is_nullable, c.column_default
+FROM information_schema.columns c
+JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+WHERE t.table_type = 'BASE TABLE' AND c.table_schema NOT IN ('pg_catalog', 'information_schema')
+ORDER BY c.table_schema, c.table_name, c.ordinal_position`)
+	if err != nil {
+		return nil, w.Wrapf(err, "cannot query information schema")
+	}
+	defer rows.Close()
+
+	schema := &Schema{}
+	tables := make(map[[2]string]*Table)
+	for rows.Next() {
+		var table [2]string
+		var column TableColumn
+		var nullable string
+		if err = rows.Scan(&table[0], &table[1], &column.Name, &column.DataType, &nullable, &column.Default); err != nil {
+			return nil, w.Wrapf(err, "cannot read column")
+		}
+		if ignoredTables[table[1]] || slices.Contains(ignored, table[1]) {
+			continue
+		}
+		column.Nullable = nullable == "YES"
+		if tables[table] == nil {
+			tables[table] = &Table{Schema: table[0], Name: table[1], Columns: []*TableColumn{}, Indexes: []*Index{}}
+			schema.Tables = append(schema.Tables, tables[table])
+		}
+		tables[table].Columns = append(tables[table].Columns, &column)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, w.Wrapf(err, "cannot read columns")
+	}
+
+	// Indexes are not part of information_schema
+	rows, err = db.QueryContext(ctx, `SELECT schemaname, tablename, indexname, indexdef
+FROM pg_indexes
+WHERE schemaname NOT IN ('pg_catalog', 'information_schema')
+ORDER BY schemaname, tablename, indexname`)
+	if err != nil {
+		return nil, w.Wrapf(err, "cannot query indexes")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table [2]string
+		var index Index
+		if err = rows.Scan(&table[0], &table[1], &index.Name, &index.Definition); err != nil {
+			return nil, w.Wrapf(err, "cannot read index")
+		}
+		if tables[table] != nil {
+			tables[table].Indexes = append(tables[table].Indexes, &index)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, w.Wrapf(err, "cannot read indexes")
+	}
+	return schema, nil
+}
+
+// Write the schema as indented JSON, creating the directory of the file
+func (schema *Schema) Write(ctx context.Context, file string) error {
+	w := wool.Get(ctx).In("models.Schema.Write", wool.FileField(file))
+	if schema.Tables == nil {
+		schema.Tables = []*Table{}
+	}
+	content, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return w.Wrapf(err, "cannot marshal schema")
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return w.Wrapf(err, "cannot create output directory")
+	}
+	if err = os.WriteFile(file, append(content, '\n'), 0o644); err != nil {
+		return w.Wrapf(err, "cannot write schema")
+	}
+	w.Debug("dumped schema", wool.Field("tables", len(schema.Tables)))
+	return nil
+}
+
+// DumpSchema introspects the database and writes its schema to the file
+func DumpSchema(ctx context.Context, db *sql.DB, file string, ignored ...string) error {
+	schema, err := IntrospectSchema(ctx, db, ignored...)
+	if err != nil {
+		return err
+	}
+	return schema.Write(ctx, file)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/codefly-dev/core/wool"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// checkNetwork fails when the docker network doesn't exist: docker would only tell when starting a container
+func checkNetwork(ctx context.Context, cli *client.Client, name string) error {
+	w := wool.Get(ctx).In("checkNetwork", wool.NameField(name))
+	_, err := cli.NetworkInspect(ctx, name, network.InspectOptions{})
+	if client.IsErrNotFound(err) {
+		return w.NewError("docker network %s doesn't exist: create it with `docker network create %s` or change docker-network", name, name)
+	}
+	if err != nil {
+		return w.Wrapf(err, "cannot inspect docker network")
+	}
+	return nil
+}
+
+// attachNetwork connects the postgres container to the docker network: a reused container may already be in it
+func (s *Runtime) attachNetwork(ctx context.Context) error {
+	name := s.Settings.DockerNetwork
+	return s.withContainer(ctx, func(cli *client.Client, id string) error {
+		if err := checkNetwork(ctx, cli, name); err != nil {
+			return err
+		}
+		inspect, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return s.Wool.Wrapf(err, "cannot inspect container")
+		}
+		if inspect.NetworkSettings != nil {
+			if _, ok := inspect.NetworkSettings.Networks[name]; ok {
+				return nil
+			}
+		}
+		if err = cli.NetworkConnect(ctx, name, id, nil); err != nil {
+			return s.Wool.Wrapf(err, "cannot attach container to docker network %s", name)
+		}
+		s.Wool.Debug("attached container to docker network", wool.NameField(name))
+		return nil
+	})
+}
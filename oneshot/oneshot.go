@@ -0,0 +1,140 @@
+package oneshot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/codefly-dev/core/resources"
+	runners "github.com/codefly-dev/core/runners/base"
+	"github.com/codefly-dev/core/wool"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Container runs one command to completion: it is removed once done
+type Container struct {
+	// Name of the container, made unique by the caller
+	Name  string
+	Image *resources.DockerImage
+
+	Cmd []string
+	Env []string
+
+	// User running the command: image default when empty
+	User string
+
+	Mounts []mount.Mount
+
+	// Network the container joins instead of the default bridge
+	Network string
+
+	// Resources limits the memory and CPU of the container
+	Resources container.Resources
+}
+
+// WithRegistry pulls the image from a mirror: the prefix is prepended to its repository
+func WithRegistry(prefix string, image *resources.DockerImage) *resources.DockerImage {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return image
+	}
+	mirrored := *image
+	mirrored.Repository = prefix
+	if image.Repository != "" {
+		mirrored.Repository = prefix + "/" + image.Repository
+	}
+	return &mirrored
+}
+
+// Run the container and forward its logs: a non-zero exit code is an error ending with the last lines of the logs
+func Run(ctx context.Context, c *Container) error {
+	w := wool.Get(ctx).In("oneshot.Run", wool.NameField(c.Name))
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return w.Wrapf(err, "cannot create docker client")
+	}
+	defer cli.Close()
+
+	err = runners.GetImageIfNotPresent(ctx, cli, c.Image, w)
+	if err != nil {
+		return w.Wrapf(err, "cannot get image")
+	}
+
+	config := &container.Config{
+		Image: c.Image.FullName(),
+		Cmd:   c.Cmd,
+		Env:   c.Env,
+		User:  c.User,
+	}
+	hostConfig := &container.HostConfig{
+		Mounts:    c.Mounts,
+		Resources: c.Resources,
+	}
+	if c.Network != "" {
+		hostConfig.NetworkMode = container.NetworkMode(c.Network)
+	}
+	if runtime.GOOS == "linux" {
+		hostConfig.ExtraHosts = []string{"host.docker.internal:172.17.0.1"}
+	}
+
+	resp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, nil, runners.ContainerName(c.Name))
+	if err != nil {
+		return w.Wrapf(err, "cannot create container")
+	}
+	defer func() {
+		err := cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true})
+		if err != nil {
+			w.Warn("cannot remove container", wool.ErrField(err))
+		}
+	}()
+
+	if err = cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return w.Wrapf(err, "cannot start container")
+	}
+
+	var code int64
+	statusCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	select {
+	case err = <-errCh:
+		return w.Wrapf(err, "cannot wait for container")
+	case status := <-statusCh:
+		code = status.StatusCode
+	}
+
+	logs, err := cli.ContainerLogs(ctx, resp.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return w.Wrapf(err, "cannot get logs")
+	}
+	defer logs.Close()
+	tail := NewTail(DefaultTailLines)
+	out := io.MultiWriter(w, tail)
+	if _, err = stdcopy.StdCopy(out, out, logs); err != nil {
+		w.Warn("cannot read logs", wool.ErrField(err))
+	}
+
+	if code != 0 {
+		return w.NewError("%s exited with code %d%s", fmt.Sprint(c.Cmd), code, tail.Suffix())
+	}
+	return nil
+}
+
+// Remove a container left running, for example by an interrupted Run: a missing container is not an error
+func Remove(ctx context.Context, name string) error {
+	w := wool.Get(ctx).In("oneshot.Remove", wool.NameField(name))
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return w.Wrapf(err, "cannot create docker client")
+	}
+	defer cli.Close()
+
+	err = cli.ContainerRemove(ctx, runners.ContainerName(name), container.RemoveOptions{Force: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		return w.Wrapf(err, "cannot remove container")
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package oneshot
+
+import (
+	"testing"
+
+	"github.com/codefly-dev/core/resources"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithRegistry(t *testing.T) {
+	postgres := &resources.DockerImage{Name: "postgres", Tag: "16.1-alpine"}
+	dbmate := &resources.DockerImage{Repository: "ghcr.io/amacneil", Name: "dbmate", Tag: "2.19.0"}
+
+	require.Equal(t, "postgres:16.1-alpine", WithRegistry("", postgres).FullName())
+	require.Equal(t, "registry.internal/mirror/postgres:16.1-alpine", WithRegistry("registry.internal/mirror", postgres).FullName())
+	require.Equal(t, "registry.internal/mirror/postgres:16.1-alpine", WithRegistry("registry.internal/mirror/", postgres).FullName())
+	require.Equal(t, "registry.internal/ghcr.io/amacneil/dbmate:2.19.0", WithRegistry("registry.internal", dbmate).FullName())
+
+	// The default image is left untouched
+	require.Equal(t, "postgres:16.1-alpine", postgres.FullName())
+}
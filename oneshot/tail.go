@@ -0,0 +1,72 @@
+package oneshot
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// DefaultTailLines is enough output to explain a failure without flooding the error
+const DefaultTailLines = 50
+
+// Tail keeps the last lines written to it
+type Tail struct {
+	sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func NewTail(max int) *Tail {
+	return &Tail{max: max}
+}
+
+func (t *Tail) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	data := append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		t.add(string(data[:i]))
+		data = data[i+1:]
+	}
+	t.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+func (t *Tail) add(line string) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// String returns the kept lines, the unterminated one included
+func (t *Tail) String() string {
+	t.Lock()
+	defer t.Unlock()
+	lines := t.lines
+	if len(t.partial) > 0 {
+		lines = append(append([]string(nil), lines...), string(t.partial))
+		if len(lines) > t.max {
+			lines = lines[len(lines)-t.max:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Suffix formats the output to end an error message: empty without output
+func (t *Tail) Suffix() string {
+	output := t.String()
+	if output == "" {
+		return ""
+	}
+	return "\noutput:\n" + output
+}
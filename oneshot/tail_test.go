@@ -0,0 +1,25 @@
+package oneshot
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTail(t *testing.T) {
+	tail := NewTail(3)
+	require.Equal(t, "", tail.Suffix())
+
+	for i := 1; i <= 5; i++ {
+		_, err := fmt.Fprintf(tail, "line %d\n", i)
+		require.NoError(t, err)
+	}
+	require.Equal(t, "line 3\nline 4\nline 5", tail.String())
+
+	// Lines split across writes and an unterminated last line
+	_, _ = tail.Write([]byte("li"))
+	_, _ = tail.Write([]byte("ne 6\r\n\nline 7"))
+	require.Equal(t, "line 5\nline 6\nline 7", tail.String())
+	require.Equal(t, "\noutput:\nline 5\nline 6\nline 7", tail.Suffix())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	basev0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
+	"github.com/codefly-dev/core/resources"
+	runners "github.com/codefly-dev/core/runners/base"
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
+	"github.com/docker/docker/client"
+)
+
+// PgBouncerImage pools the connections of the dependencies in front of the database
+var PgBouncerImage = &resources.DockerImage{Name: "edoburu/pgbouncer", Tag: "latest"}
+
+// PgBouncer defaults: the host port is fixed, it must be free
+const (
+	defaultPgBouncerPort     = 6432
+	defaultPgBouncerPoolSize = 20
+	pgbouncerListenPort      = 6432
+)
+
+// pgbouncerUnique names the PgBouncer container next to the postgres one
+func pgbouncerUnique(unique string) string {
+	return fmt.Sprintf("%s-pgbouncer", unique)
+}
+
+func (s *Service) pgbouncerPort() uint16 {
+	if s.Settings.PgBouncerPort == 0 {
+		return defaultPgBouncerPort
+	}
+	return s.Settings.PgBouncerPort
+}
+
+// pgbouncerPoolMode follows the pooling mode the clients are set up for
+func (s *Service) pgbouncerPoolMode() string {
+	if s.Settings.PoolingMode == "" {
+		return SessionPoolingMode
+	}
+	return s.Settings.PoolingMode
+}
+
+// throughPgBouncer is the instance of the dependencies: same host, port of PgBouncer
+func (s *Service) throughPgBouncer(instance *basev0.NetworkInstance) (*basev0.NetworkInstance, error) {
+	host, _, err := net.SplitHostPort(hostAddress(instance.Address))
+	if err != nil {
+		return nil, s.Wool.Wrapf(err, "cannot parse instance address")
+	}
+	port := s.pgbouncerPort()
+	return &basev0.NetworkInstance{
+		Access:   instance.Access,
+		Host:     instance.Host,
+		Hostname: instance.Hostname,
+		Port:     uint32(port),
+		Address:  net.JoinHostPort(host, fmt.Sprintf("%d", port)),
+	}, nil
+}
+
+// pgbouncerEnvironment configures PgBouncer from the container connection of the database
+func (s *Runtime) pgbouncerEnvironment(connection string) ([]*resources.EnvironmentVariable, error) {
+	u, err := url.Parse(connection)
+	if err != nil {
+		return nil, s.Wool.Wrapf(err, "cannot parse container connection")
+	}
+	password, _ := u.User.Password()
+	poolSize := s.Settings.PgBouncerPoolSize
+	if poolSize <= 0 {
+		poolSize = defaultPgBouncerPoolSize
+	}
+	return []*resources.EnvironmentVariable{
+		resources.Env("DB_HOST", u.Hostname()),
+		resources.Env("DB_PORT", u.Port()),
+		resources.Env("DB_USER", u.User.Username()),
+		resources.Env("DB_PASSWORD", password),
+		resources.Env("DB_NAME", s.DatabaseName),
+		// postgres hashes passwords with SCRAM: PgBouncer must authenticate the same way
+		resources.Env("AUTH_TYPE", "scram-sha-256"),
+		resources.Env("POOL_MODE", s.pgbouncerPoolMode()),
+		resources.Env("DEFAULT_POOL_SIZE", poolSize),
+		resources.Env("LISTEN_PORT", pgbouncerListenPort),
+	}, nil
+}
+
+// startPgBouncer starts PgBouncer in front of the database: the dependencies connect through it,
+// migrations keep connecting directly as DDL doesn't go well with transaction pooling
+func (s *Runtime) startPgBouncer(ctx context.Context) error {
+	w := s.Wool.In("startPgBouncer")
+	connection, err := s.containerConnection(ctx)
+	if err != nil {
+		return err
+	}
+	env, err := s.pgbouncerEnvironment(connection)
+	if err != nil {
+		return err
+	}
+
+	pgbouncerImage := oneshot.WithRegistry(s.Settings.ImageRegistryPrefix, PgBouncerImage)
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return w.Wrapf(err, "cannot create docker client")
+	}
+	defer cli.Close()
+	if err = runners.GetImageIfNotPresent(ctx, cli, pgbouncerImage, s.Wool); err != nil {
+		return w.Wrapf(err, "cannot pull pgbouncer image")
+	}
+
+	// The configuration is only read on start: a container of a previous run may have stale credentials
+	unique := pgbouncerUnique(s.UniqueWithWorkspace())
+	if err = oneshot.Remove(ctx, unique); err != nil {
+		return w.Wrapf(err, "cannot remove previous pgbouncer")
+	}
+
+	runner, err := runners.NewDockerHeadlessEnvironment(ctx, pgbouncerImage, unique)
+	if err != nil {
+		return w.Wrapf(err, "cannot create pgbouncer runner")
+	}
+	runner.WithOutput(s.Wool)
+	runner.WithPortMapping(ctx, s.pgbouncerPort(), pgbouncerListenPort)
+	runner.WithEnvironmentVariables(ctx, env...)
+	if err = runner.Init(ctx); err != nil {
+		return w.Wrapf(err, "cannot start pgbouncer")
+	}
+	w.Info("pgbouncer started", wool.Field("port", s.pgbouncerPort()), wool.Field("pool-mode", s.pgbouncerPoolMode()))
+	return nil
+}
+
+// stopPgBouncer removes the PgBouncer container, also the one of a previous runtime
+func (s *Runtime) stopPgBouncer(ctx context.Context) error {
+	err := oneshot.Remove(ctx, pgbouncerUnique(s.UniqueWithWorkspace()))
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot stop pgbouncer")
+	}
+	return nil
+}
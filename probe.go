@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/codefly-dev/core/wool"
+)
+
+// probeShutdownTimeout lets the probes in flight answer before the server closes
+const probeShutdownTimeout = 5 * time.Second
+
+// probeHandler serves the health of the runtime for HTTP probes:
+// /healthz while the database accepts connections, /readyz once the migrations are applied too,
+// and /metrics in the Prometheus text format
+func (s *Runtime) probeHandler() http.Handler {
+	mux := http.NewServeMux()
+	probe := func(ok func(*HealthStatus) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			health := s.Health(r.Context())
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if !ok(health) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			message := string(health.State)
+			if health.Message != "" {
+				message += ": " + health.Message
+			}
+			_, _ = fmt.Fprintln(w, message)
+		}
+	}
+	mux.HandleFunc("/healthz", probe(func(h *HealthStatus) bool { return h.State != HealthContainerDown }))
+	mux.HandleFunc("/readyz", probe(func(h *HealthStatus) bool { return h.State == HealthHealthy }))
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = fmt.Fprint(w, s.Metrics())
+	})
+	return mux
+}
+
+// startProbeServer serves the probes on the probe-port: a restart keeps the running server
+func (s *Runtime) startProbeServer() error {
+	if s.probeServer != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Settings.ProbePort))
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot listen on probe port %d", s.Settings.ProbePort)
+	}
+	s.probeServer = &http.Server{Handler: s.probeHandler(), ReadHeaderTimeout: healthTimeout}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.Wool.Warn("probe server stopped", wool.ErrField(err))
+		}
+	}(s.probeServer)
+	s.Wool.Debug("serving probes", wool.Field("port", s.Settings.ProbePort))
+	return nil
+}
+
+// stopProbeServer closes the probe server, if any
+func (s *Runtime) stopProbeServer(ctx context.Context) {
+	if s.probeServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeShutdownTimeout)
+	defer cancel()
+	if err := s.probeServer.Shutdown(ctx); err != nil {
+		s.Wool.Warn("cannot stop probe server", wool.ErrField(err))
+	}
+	s.probeServer = nil
+}
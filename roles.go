@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"github.com/codefly-dev/core/wool"
+	"github.com/lib/pq"
+)
+
+// RoleSpec is a role of the application, created before the migrations grant it privileges
+type RoleSpec struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"` // Secret: never logged
+	Login    bool   `yaml:"login"`
+}
+
+// roleName is a lowercase identifier which doesn't need quoting
+var roleName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// validateRoles checks the role names before any statement runs
+func validateRoles(roles []RoleSpec) error {
+	for _, role := range roles {
+		if !roleName.MatchString(role.Name) {
+			return wool.Get(context.Background()).In("validateRoles").NewError("invalid role name %q: use lowercase letters, digits and underscores", role.Name)
+		}
+	}
+	return nil
+}
+
+// roleStatement creates the role or, when it exists, keeps its login and password in sync with the settings
+func roleStatement(role RoleSpec, exists bool) string {
+	verb := "CREATE"
+	if exists {
+		verb = "ALTER"
+	}
+	login := "NOLOGIN"
+	if role.Login {
+		login = "LOGIN"
+	}
+	statement := fmt.Sprintf("%s ROLE %s WITH %s", verb, pq.QuoteIdentifier(role.Name), login)
+	if role.Password != "" {
+		statement = fmt.Sprintf("%s PASSWORD %s", statement, pq.QuoteLiteral(role.Password))
+	}
+	return statement
+}
+
+// createRoles creates the roles of the settings from the admin database: safe to re-run
+func (s *Runtime) createRoles(ctx context.Context) error {
+	if err := validateRoles(s.Settings.Roles); err != nil {
+		return err
+	}
+	admin, err := sql.Open("postgres", s.adminConnection)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot open admin database")
+	}
+	defer admin.Close()
+
+	for _, role := range s.Settings.Roles {
+		var exists bool
+		err = admin.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_roles WHERE rolname = $1)", role.Name).Scan(&exists)
+		if err != nil {
+			return s.Wool.Wrapf(err, "cannot check role %s", role.Name)
+		}
+		// The statement holds the password: errors only name the role
+		if _, err = admin.ExecContext(ctx, roleStatement(role, exists)); err != nil {
+			return s.Wool.Wrapf(err, "cannot set up role %s", role.Name)
+		}
+		s.Wool.Debug("role ready", wool.Field("role", role.Name), wool.Field("created", !exists))
+	}
+	return nil
+}
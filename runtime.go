@@ -3,12 +3,25 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	basev0 "github.com/codefly-dev/core/generated/go/codefly/base/v0"
+	"math/rand/v2"
+	"net/http"
 	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/codefly-dev/core/agents/helpers/code"
+	"github.com/codefly-dev/core/builders"
+	"github.com/codefly-dev/service-external-postgres/migrations"
+	"github.com/codefly-dev/service-external-postgres/models"
+	"github.com/codefly-dev/service-external-postgres/oneshot"
 
 	"github.com/codefly-dev/core/agents/services"
 	"github.com/codefly-dev/core/wool"
@@ -17,8 +30,12 @@ import (
 	runtimev0 "github.com/codefly-dev/core/generated/go/codefly/services/runtime/v0"
 	"github.com/codefly-dev/core/resources"
 	runners "github.com/codefly-dev/core/runners/base"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/lib/pq"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+	"github.com/lib/pq"
 )
 
 type Runtime struct {
@@ -27,32 +44,151 @@ type Runtime struct {
 	// internal
 	runnerEnvironment *runners.DockerEnvironment
 
+	migrationManager migrations.Manager
+	migrationConfig  *migrations.Config
+
+	// migrationLock serializes the migration runs of start and hot-reload
+	migrationLock sync.Mutex
+
+	// reload coalesces the hot-reload events into one migration run
+	reload *debouncer
+
+	// address of the database from the agent: the connection is rebuilt on it when the credentials rotate
+	address string
+
+	// suspended is the stop behavior applied to the container: Start resumes it
+	suspended string
+
+	// stalePassword initialized the reused container: Start replaces it with the configured one
+	stalePassword string
+
+	// timings of the last run of each lifecycle step
+	timings map[string]*phaseTimings
+
+	// readiness of the database at the last start
+	readiness *readiness
+
+	// metrics of the migrations applied since Init
+	metrics *migrationMetrics
+
+	// db is the pool shared by the queries of the runtime
+	db *sql.DB
+
+	// probeServer serves the HTTP probes on the probe-port
+	probeServer *http.Server
+
+	// requirements watched for hot-reload
+	requirements *builders.Dependencies
+
+	// postgresImage running the database: the fallback one when the pull failed
+	postgresImage *resources.DockerImage
+
 	postgresPort uint16
+
+	// hostPort mapped to the postgres port
+	hostPort uint16
+
+	// container running the database, as listed by docker ps
+	containerName string
+	containerID   string
+}
+
+// Pool settings of the runtime database handle
+const (
+	maxOpenConnections    = 4
+	connectionMaxLifetime = 5 * time.Minute
+)
+
+// Readiness defaults when not set in the settings
+const (
+	defaultReadinessRetries = 7
+	defaultReadinessDelay   = 500 * time.Millisecond
+)
+
+// Readiness backoff: the delay doubles up to maxReadinessDelay, each attempt is bounded by readinessConnectTimeout
+const (
+	maxReadinessDelay       = 10 * time.Second
+	readinessConnectTimeout = 10 * time.Second
+	readinessJitter         = 0.2
+)
+
+// readinessDelays is the backoff schedule between the attempts, without the jitter
+func readinessDelays(attempts int, delay time.Duration) []time.Duration {
+	var delays []time.Duration
+	for i := 1; i < attempts; i++ {
+		delays = append(delays, delay)
+		delay = min(2*delay, maxReadinessDelay)
+	}
+	return delays
+}
+
+// withJitterBound is the longest a delay lasts with the jitter
+func withJitterBound(delay time.Duration) time.Duration {
+	return delay + time.Duration(float64(delay)*readinessJitter)
+}
+
+// withJitter spreads a delay by readinessJitter so restarted services don't ping in lockstep
+func withJitter(delay time.Duration) time.Duration {
+	spread := int64(float64(delay) * readinessJitter)
+	if spread <= 0 {
+		return delay
+	}
+	return delay + time.Duration(rand.Int64N(2*spread+1)-spread)
 }
 
 func NewRuntime() *Runtime {
 	return &Runtime{
 		Service: NewService(),
+		timings: make(map[string]*phaseTimings),
 	}
 }
 
+// timeStep starts timing a lifecycle step: the timings are logged when it returns
+func (s *Runtime) timeStep(step string) *phaseTimings {
+	timings := newPhaseTimings(step)
+	s.timings[step] = timings
+	return timings
+}
+
 func (s *Runtime) Load(ctx context.Context, req *runtimev0.LoadRequest) (*runtimev0.LoadResponse, error) {
 	defer s.Wool.Catch()
 	ctx = s.Wool.Inject(ctx)
 
 	s.Runtime.LogLoadRequest(req)
 
+	timings := s.timeStep("load")
+	defer timings.log(s.Wool)
+
+	done := timings.track("settings")
 	err := s.Base.Load(ctx, req.Identity, s.Settings)
+	done()
 	if err != nil {
 		return s.Runtime.LoadErrorf(err, "loading base")
 	}
 
+	err = s.Settings.Validate()
+	if err != nil {
+		return s.Runtime.LoadError(err)
+	}
+
 	s.Runtime.SetEnvironment(req.Environment)
 
-	requirements.Localize(s.Location)
+	err = s.checkHostAuthMethod(req.Environment)
+	if err != nil {
+		return s.Runtime.LoadError(err)
+	}
+
+	dirs := s.migrationDirs()
+	s.requirements = newRequirements(dirs[0], s.watchPatterns()...)
+	for _, dir := range dirs[1:] {
+		s.requirements.AddDependencies(migrationDependency(dir, s.watchPatterns()...))
+	}
+	s.requirements.Localize(s.Location)
 
 	// Endpoints
+	done = timings.track("endpoints")
 	s.Endpoints, err = s.Runtime.Service.LoadEndpoints(ctx)
+	done()
 	if err != nil {
 		return s.Runtime.LoadErrorf(err, "cannot load endpoints")
 	}
@@ -61,12 +197,59 @@ func (s *Runtime) Load(ctx context.Context, req *runtimev0.LoadRequest) (*runtim
 
 	s.TcpEndpoint, err = resources.FindTCPEndpoint(ctx, s.Endpoints)
 	if err != nil {
-		return s.Runtime.LoadErrorf(err, "cannot find TCP endpoint")
+		return s.Runtime.LoadErrorf(err, "no TCP endpoint configured for postgres service")
 	}
 
 	return s.Runtime.LoadResponse()
 }
 
+// runtimeConfigurations exports the connection strings of every instance of the network mapping
+func (s *Runtime) runtimeConfigurations(ctx context.Context, net *basev0.NetworkMapping) ([]*basev0.Configuration, error) {
+	var configurations []*basev0.Configuration
+	for _, inst := range net.Instances {
+		if s.Settings.EnablePgBouncer {
+			var err error
+			inst, err = s.throughPgBouncer(inst)
+			if err != nil {
+				return nil, err
+			}
+		}
+		conf, err := s.CreateConnectionConfiguration(ctx, s.Configuration, inst, s.withSSL(s.Runtime.Environment))
+		if err != nil {
+			return nil, err
+		}
+		s.Wool.Debug("adding configuration", wool.Field("config", resources.MakeConfigurationSummary(conf)), wool.Field("instance", inst))
+		configurations = append(configurations, conf)
+	}
+	return configurations, nil
+}
+
+// migrationDir of the active environment, relative to the service
+func (s *Runtime) migrationDir() string {
+	if s.Runtime.Environment != nil {
+		if dir, ok := s.Settings.MigrationDirByEnvironment[s.Runtime.Environment.Name]; ok && dir != "" {
+			return dir
+		}
+	}
+	return defaultMigrationDir
+}
+
+// migrationDirs applied in order, relative to the service: the directory of the environment by default
+func (s *Runtime) migrationDirs() []string {
+	if len(s.Settings.MigrationDirs) > 0 {
+		return s.Settings.MigrationDirs
+	}
+	return []string{s.migrationDir()}
+}
+
+// watchPatterns of the migration files: from the settings or the migration format
+func (s *Runtime) watchPatterns() []string {
+	if len(s.Settings.MigrationWatchPatterns) > 0 {
+		return s.Settings.MigrationWatchPatterns
+	}
+	return migrations.WatchPatterns(s.Settings.MigrationFormat)
+}
+
 func CallingContext() *basev0.NetworkAccess {
 	if _, err := os.Stat("/.dockerenv"); err == nil {
 		return resources.NewContainerNetworkAccess()
@@ -82,8 +265,23 @@ func (s *Runtime) Init(ctx context.Context, req *runtimev0.InitRequest) (*runtim
 
 	w := s.Wool.In("runtime::init")
 
+	timings := s.timeStep("init")
+	defer timings.log(s.Wool)
+
+	// Load found no endpoint: everything below is about its network
+	if s.TcpEndpoint == nil {
+		return s.Runtime.InitError(w.NewError("no TCP endpoint configured for postgres service"))
+	}
+
+	done := timings.track("configuration")
+
 	s.NetworkMappings = req.ProposedNetworkMappings
 
+	// Fail before any network or container work: the configuration is only known from Init
+	err := s.ValidateConfiguration(ctx, req.Configuration)
+	if err != nil {
+		return s.Runtime.InitError(err)
+	}
 	s.Configuration = req.Configuration
 
 	net, err := resources.FindNetworkMapping(ctx, s.NetworkMappings, s.TcpEndpoint)
@@ -94,6 +292,9 @@ func (s *Runtime) Init(ctx context.Context, req *runtimev0.InitRequest) (*runtim
 	if net == nil {
 		return s.Runtime.InitError(w.NewError("network mapping is nil"))
 	}
+	if len(net.Instances) == 0 {
+		return s.Runtime.InitError(w.NewError("network mapping of the TCP endpoint %s has no instance", s.TcpEndpoint.Name))
+	}
 
 	instance, err := resources.FindNetworkInstanceInNetworkMappings(ctx, s.NetworkMappings, s.TcpEndpoint, CallingContext())
 	if err != nil {
@@ -110,13 +311,9 @@ func (s *Runtime) Init(ctx context.Context, req *runtimev0.InitRequest) (*runtim
 	s.postgresPort = 5432
 
 	// Create connection string resources for the network instance
-	for _, inst := range net.Instances {
-		conf, errConn := s.CreateConnectionConfiguration(ctx, s.Configuration, inst, false)
-		if errConn != nil {
-			return s.Runtime.InitError(errConn)
-		}
-		w.Debug("adding configuration", wool.Field("config", resources.MakeConfigurationSummary(conf)), wool.Field("instance", inst))
-		s.Runtime.RuntimeConfigurations = append(s.Runtime.RuntimeConfigurations, conf)
+	s.Runtime.RuntimeConfigurations, err = s.runtimeConfigurations(ctx, net)
+	if err != nil {
+		return s.Runtime.InitError(err)
 	}
 	s.Wool.Debug("sending runtime configuration", wool.Field("conf", resources.MakeManyConfigurationSummary(s.Runtime.RuntimeConfigurations)))
 
@@ -128,15 +325,91 @@ func (s *Runtime) Init(ctx context.Context, req *runtimev0.InitRequest) (*runtim
 
 	}
 
-	s.connection, err = s.createConnectionString(ctx, s.Configuration, hostInstance.Address, false)
+	s.address = hostInstance.Address
+	s.connection, err = s.createConnectionString(ctx, s.Configuration, s.address, s.withSSL(s.Runtime.Environment))
 	if err != nil {
 		return s.Runtime.InitError(err)
 	}
 
-	w.Debug("connection string", wool.Field("connection", s.connection))
+	s.adminConnection, err = s.createAdminConnectionString(ctx, s.Configuration, s.address, s.withSSL(s.Runtime.Environment))
+	if err != nil {
+		return s.Runtime.InitError(err)
+	}
+	containerConnection, err := s.containerConnection(ctx)
+	if err != nil {
+		return s.Runtime.InitError(err)
+	}
+
+	w.Debug("connection string", wool.Field("connection", s.MaskedConnection()))
+
+	limits, err := s.containerResources()
+	if err != nil {
+		return s.Runtime.InitError(err)
+	}
+	s.migrationConfig = &migrations.Config{
+		DatabaseName: s.DatabaseName,
+		MigrationDir: s.Local(s.migrationDirs()[0]),
+		Connection:   s.connection,
+		User:         s.Settings.MigrationUser,
+		Password:     s.migrationPassword,
+		Unique:       s.UniqueWithWorkspace(),
+
+		AdminConnection:     s.adminConnection,
+		ContainerConnection: containerConnection,
+
+		CallingContext: CallingContext(),
+
+		MigrationTimeout:    s.Settings.MigrationTimeout,
+		VerificationQuery:   s.Settings.VerificationQuery,
+		VerificationTimeout: s.Settings.VerificationTimeout,
+		ConnectRetries:      s.Settings.MigrationConnectRetries,
+
+		MultiStatementEnabled: s.Settings.MultiStatementEnabled,
+		MultiStatementMaxSize: s.Settings.MultiStatementMaxSize,
+		StatementTimeout:      s.Settings.StatementTimeout,
+		MigrationsTable:       s.Settings.MigrationsTable,
+		Schema:                s.Settings.Schema,
+
+		AutoRecoverDirty: s.Settings.AutoRecoverDirty,
+
+		Resources: limits,
+
+		TargetVersion: s.Settings.MigrateToVersion,
+		PGOptions:     s.Settings.MigrationPGOptions,
+
+		ImageRegistryPrefix: s.Settings.ImageRegistryPrefix,
+
+		DockerNetwork:  s.Settings.DockerNetwork,
+		NetworkAddress: fmt.Sprintf("%s:%d", runners.ContainerName(s.UniqueWithWorkspace()), s.postgresPort),
+	}
+	for _, dir := range s.Settings.MigrationDirs {
+		s.migrationConfig.MigrationDirs = append(s.migrationConfig.MigrationDirs, s.Local(dir))
+	}
+	// A mismatch otherwise shows as a deep failure of the migration tool
+	for _, dir := range append([]string{s.migrationConfig.MigrationDir}, s.migrationConfig.MigrationDirs...) {
+		mismatch, err := migrations.FormatMismatch(dir, s.Settings.MigrationFormat)
+		if err != nil {
+			w.Debug("cannot detect migration format", wool.ErrField(err))
+		}
+		if mismatch != "" {
+			w.Warn(mismatch, wool.DirField(dir))
+		}
+	}
+	s.migrationManager, err = migrations.NewManager(ctx, s.Settings.MigrationFormat, s.migrationConfig)
+	if err != nil {
+		return s.Runtime.InitError(err)
+	}
+	format := s.Settings.MigrationFormat
+	if format == migrations.AutoFormat {
+		// NewManager succeeded: the directory has a single format
+		format, _ = migrations.DetectFormat(s.migrationConfig.MigrationDir)
+	}
+	if format == "" {
+		format = migrations.GolangMigrateFormat
+	}
+	s.metrics = newMigrationMetrics(format, s.DatabaseName)
 
-	// Docker
-	runner, err := runners.NewDockerHeadlessEnvironment(ctx, image, s.UniqueWithWorkspace())
+	err = s.migrationManager.Init(ctx, s.Runtime.RuntimeConfigurations)
 	if err != nil {
 		return s.Runtime.InitError(err)
 	}
@@ -146,54 +419,296 @@ func (s *Runtime) Init(ctx context.Context, req *runtimev0.InitRequest) (*runtim
 		return s.Runtime.InitError(err)
 	}
 
+	err = s.checkPostgresConf()
+	if err != nil {
+		return s.Runtime.InitError(err)
+	}
+	done()
+
+	// Docker: the image is pulled when not present, unless a matching container is reused
+	done = timings.track("image-pull")
+	s.hostPort = uint16(instance.Port)
+	reused, err := s.handleExistingContainer(ctx)
+	if err == nil && !reused {
+		s.postgresImage, err = s.pullImage(ctx)
+	}
+	if err != nil {
+		done()
+		return s.Runtime.InitError(err)
+	}
+	runner, err := runners.NewDockerHeadlessEnvironment(ctx, s.postgresImage, s.UniqueWithWorkspace())
+	done()
+	if err != nil {
+		return s.Runtime.InitError(err)
+	}
+
 	runner.WithOutput(s.Wool)
-	runner.WithPortMapping(ctx, uint16(instance.Port), s.postgresPort)
+	runner.WithPortMapping(ctx, s.hostPort, s.postgresPort)
 
-	runner.WithEnvironmentVariables(
-		ctx,
-		resources.Env("POSTGRES_USER", s.postgresUser),
-		resources.Env("POSTGRES_PASSWORD", s.postgresPassword),
-		resources.Env("POSTGRES_DB", s.DatabaseName))
+	runner.WithEnvironmentVariables(ctx, s.containerEnvironment()...)
+
+	// Used by initdb only: they don't change an initialized database
+	if s.Settings.InitdbArgs != "" {
+		runner.WithEnvironmentVariables(ctx, resources.Env("POSTGRES_INITDB_ARGS", s.Settings.InitdbArgs))
+	}
+	if s.Settings.Locale != "" {
+		runner.WithEnvironmentVariables(ctx,
+			resources.Env("LANG", s.Settings.Locale),
+			resources.Env("LC_COLLATE", s.Settings.Locale))
+	}
+
+	if len(s.Settings.ServerParameters) > 0 {
+		cmd, errCmd := s.serverCommand()
+		if errCmd != nil {
+			return s.Runtime.InitError(errCmd)
+		}
+		runner.WithCommand(cmd...)
+	}
+	if s.Settings.PostgresConfPath != "" {
+		runner.WithMount(s.Local(s.Settings.PostgresConfPath), postgresConfFile)
+		runner.WithCommand("postgres", "-c", fmt.Sprintf("config_file=%s", postgresConfFile))
+	}
 
 	s.runnerEnvironment = runner
 
 	w.Debug("init for runner environment: will start container")
+	done = timings.track("container-start")
 	err = s.runnerEnvironment.Init(ctx)
+	if err == nil && s.Settings.DockerNetwork != "" {
+		err = s.attachNetwork(ctx)
+	}
+	if err == nil && (s.Settings.ContainerMemoryLimit != "" || s.Settings.ContainerCPULimit != "") {
+		err = s.limitContainer(ctx)
+	}
+	if err == nil {
+		s.containerID, err = s.runnerEnvironment.ContainerID()
+	}
+	done()
 	if err != nil {
 		return s.Runtime.InitError(err)
 	}
+	s.containerName = runners.ContainerName(s.UniqueWithWorkspace())
+	w.Debug("postgres container", wool.Field("name", s.containerName), wool.Field("id", s.containerID))
+
+	if len(s.Settings.PreStartCommand) > 0 {
+		done = timings.track("pre-start-command")
+		err = s.runPreStartCommand(ctx)
+		done()
+		if err != nil {
+			return s.Runtime.InitError(err)
+		}
+	}
+
+	if s.Settings.EnablePgBouncer {
+		done = timings.track("pgbouncer-start")
+		err = s.startPgBouncer(ctx)
+		done()
+		if err != nil {
+			return s.Runtime.InitError(err)
+		}
+	}
 
 	s.Wool.Debug("init successful")
 	return s.Runtime.InitResponse()
 }
 
+// postgresConfFile is where the configuration file of the settings is mounted
+const postgresConfFile = "/etc/postgresql/postgresql.conf"
+
+// checkPostgresConf fails early on a configuration file postgres couldn't read
+func (s *Runtime) checkPostgresConf() error {
+	if s.Settings.PostgresConfPath == "" {
+		return nil
+	}
+	if len(s.Settings.ServerParameters) > 0 {
+		return s.Wool.NewError("postgres-conf-path and server-parameters both configure the server: move the parameters into %s", s.Settings.PostgresConfPath)
+	}
+	file := s.Local(s.Settings.PostgresConfPath)
+	f, err := os.Open(file)
+	if err != nil {
+		return s.Wool.With(wool.FileField(file)).Wrapf(err, "cannot read postgres configuration file")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return s.Wool.With(wool.FileField(file)).Wrapf(err, "cannot read postgres configuration file")
+	}
+	if info.IsDir() {
+		return s.Wool.With(wool.FileField(file)).NewError("postgres configuration is a directory, not a file")
+	}
+	return nil
+}
+
+// serverParameterName is the character set of a postgres parameter, extension ones included
+var serverParameterName = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+// serverCommand runs postgres with one -c argument per server parameter, sorted for a stable command
+func (s *Service) serverCommand() ([]string, error) {
+	parameters := s.Settings.ServerParameters
+	keys := make([]string, 0, len(parameters))
+	for key := range parameters {
+		if !serverParameterName.MatchString(key) {
+			return nil, s.Wool.NewError("invalid server parameter name: %q", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	cmd := []string{"postgres"}
+	for _, key := range keys {
+		cmd = append(cmd, "-c", fmt.Sprintf("%s=%s", key, parameters[key]))
+	}
+	return cmd, nil
+}
+
+// image running the database
+func (s *Runtime) image() *resources.DockerImage {
+	if s.postgresImage == nil {
+		return s.runtimeImage()
+	}
+	return s.postgresImage
+}
+
+// pullImage pulls the postgres image: the fallback image is used only when the pull fails
+func (s *Runtime) pullImage(ctx context.Context) (*resources.DockerImage, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, s.Wool.Wrapf(err, "cannot create docker client")
+	}
+	defer cli.Close()
+
+	resolved := s.runtimeImage()
+	err = runners.GetImageIfNotPresent(ctx, cli, resolved, s.Wool)
+	if err == nil || s.Settings.FallbackImage == "" {
+		return resolved, err
+	}
+	fallback := resources.NewDockerImage(s.Settings.FallbackImage)
+	if fallback == nil {
+		return nil, s.Wool.Wrapf(err, "invalid fallback image: %s", s.Settings.FallbackImage)
+	}
+	s.Wool.Warn(fmt.Sprintf("cannot pull %s: USING FALLBACK IMAGE %s", resolved.FullName(), fallback.FullName()), wool.ErrField(err))
+	err = runners.GetImageIfNotPresent(ctx, cli, fallback, s.Wool)
+	if err != nil {
+		return nil, s.Wool.Wrapf(err, "cannot pull fallback image")
+	}
+	return fallback, nil
+}
+
+// database returns the pool of the runtime, opened on first use and closed on Destroy
+func (s *Runtime) database() (*sql.DB, error) {
+	if s.db != nil {
+		return s.db, nil
+	}
+	// A connection attempt to a database still starting mustn't hang the readiness loop
+	connection, err := withQueryParameter(s.connection, "connect_timeout", strconv.Itoa(int(readinessConnectTimeout.Seconds())))
+	if err != nil {
+		return nil, s.Wool.Wrapf(err, "cannot parse connection string")
+	}
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return nil, s.Wool.Wrapf(err, "cannot open database")
+	}
+	db.SetMaxOpenConns(maxOpenConnections)
+	db.SetMaxIdleConns(maxOpenConnections)
+	db.SetConnMaxLifetime(connectionMaxLifetime)
+	s.db = db
+	return db, nil
+}
+
+// MaskedConnection is the connection string of the agent without its password: safe to share for support
+func (s *Runtime) MaskedConnection() string {
+	return migrations.MaskConnectionString(s.connection)
+}
+
+// containerConnection is the connection string reachable from other containers: built like the agent one,
+// with the same SSL settings and without the pooler parameters or the keyword format of the exported one
+func (s *Runtime) containerConnection(ctx context.Context) (string, error) {
+	instance, err := resources.FindNetworkInstanceInNetworkMappings(ctx, s.NetworkMappings, s.TcpEndpoint, resources.NewContainerNetworkAccess())
+	if err != nil {
+		return "", s.Wool.Wrapf(err, "cannot find container network instance")
+	}
+	if instance == nil {
+		return "", s.Wool.NewError("container network instance is nil")
+	}
+	return s.createConnectionString(ctx, s.Configuration, instance.Address, s.withSSL(s.Runtime.Environment))
+}
+
+// readinessCheck runs SELECT 1, or the readiness-query which must return a row
+func (s *Runtime) readinessCheck(ctx context.Context, db *sql.DB) error {
+	if s.Settings.ReadinessQuery == "" {
+		_, err := db.ExecContext(ctx, "SELECT 1")
+		return err
+	}
+	rows, err := db.QueryContext(ctx, s.Settings.ReadinessQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return s.Wool.NewError("readiness query returned no row")
+	}
+	return nil
+}
+
 func (s *Runtime) WaitForReady(ctx context.Context) error {
 	defer s.Wool.Catch()
 	ctx = s.Wool.Inject(ctx)
 
-	s.Wool.Debug("waiting for ready", wool.Field("connection", s.connection))
+	s.Wool.Debug("waiting for ready", wool.Field("connection", s.MaskedConnection()))
 
-	maxRetry := 5
-	for retry := 0; retry < maxRetry; retry++ {
-		db, err := sql.Open("postgres", s.connection)
-		if err != nil {
-			return s.Wool.Wrapf(err, "cannot open database")
-		}
+	maxRetry := s.Settings.ReadinessRetries
+	if maxRetry <= 0 {
+		maxRetry = defaultReadinessRetries
+	}
+	delay := s.Settings.ReadinessDelay
+	if delay <= 0 {
+		delay = defaultReadinessDelay
+	}
+	delays := readinessDelays(maxRetry, delay)
+
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+
+	// Readiness has its own budget: it doesn't eat into the migration one
+	deadline := readinessConnectTimeout
+	for _, d := range delays {
+		deadline += withJitterBound(d)
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
 
-		err = db.Ping()
+	start := time.Now()
+	for retry := 0; retry < maxRetry; retry++ {
+		err = db.PingContext(ctx)
 		if err == nil {
 			s.Wool.Debug("ping successful")
-			// Try to execute a simple query
-			_, err = db.Exec("SELECT 1")
+			err = s.readinessCheck(ctx, db)
 			if err == nil {
-				s.Wool.Debug("database ready!")
+				s.readiness = &readiness{duration: time.Since(start), retries: retry}
+				s.Wool.Info("database ready", wool.Field("readiness_duration_ms", s.readiness.duration.Milliseconds()), wool.Field("retries", retry))
 				return nil
 			}
 		}
-		s.Wool.Debug("waiting for database to be ready", wool.ErrField(err))
-		time.Sleep(3 * time.Second)
+		if isAuthenticationFailure(err) {
+			// Waiting won't fix the credentials
+			break
+		}
+		if retry == len(delays) {
+			break
+		}
+		wait := withJitter(delays[retry])
+		s.Wool.Debug("waiting for database to be ready", wool.ErrField(err), wool.Field("delay", wait))
+		select {
+		case <-ctx.Done():
+			return s.Wool.Wrapf(ctx.Err(), "stopped waiting for the database after %s: %v", time.Since(start).Round(time.Millisecond), err)
+		case <-time.After(wait):
+		}
 	}
-	return s.Wool.NewError("database is not ready")
+	return s.Wool.Wrapf(err, "database is not ready after %s (%d attempts)", time.Since(start).Round(time.Millisecond), maxRetry)
 }
 
 func (s *Runtime) Start(ctx context.Context, req *runtimev0.StartRequest) (*runtimev0.StartResponse, error) {
@@ -202,68 +717,782 @@ func (s *Runtime) Start(ctx context.Context, req *runtimev0.StartRequest) (*runt
 
 	s.Wool.Debug("starting")
 
+	timings := s.timeStep("start")
+	defer timings.log(s.Wool)
+
+	done := timings.track("readiness")
+	err := s.resume(ctx)
+	if err != nil {
+		return s.Runtime.StartError(err)
+	}
+
+	// Probes answer while the database gets ready and migrates
+	if s.Settings.ProbePort != 0 {
+		err = s.startProbeServer()
+		if err != nil {
+			return s.Runtime.StartError(err)
+		}
+	}
+
+	if s.stalePassword != "" {
+		err = s.syncPassword(ctx)
+		if err != nil {
+			return s.Runtime.StartError(err)
+		}
+	}
+
 	s.Wool.Debug("waiting for ready")
 
-	err := s.WaitForReady(ctx)
+	err = s.withCredentialRefresh(ctx, s.WaitForReady)
+	done()
 	if err != nil {
 		return s.Runtime.StartError(err)
 	}
 
+	if s.Settings.ResetSchemaOnStart {
+		err = s.withCredentialRefresh(ctx, s.resetSchema)
+		if err != nil {
+			return s.Runtime.StartError(err)
+		}
+	}
+
+	if len(s.Settings.Roles) > 0 {
+		err = s.withCredentialRefresh(ctx, s.createRoles)
+		if err != nil {
+			return s.Runtime.StartError(err)
+		}
+	}
+
+	if s.Settings.DefaultSearchPath != "" {
+		err = s.withCredentialRefresh(ctx, s.createSearchPathSchema)
+		if err != nil {
+			return s.Runtime.StartError(err)
+		}
+	}
+
 	if !s.Settings.NoMigration {
-		s.Wool.Debug("applying migrations")
-		err = s.applyMigration(ctx)
+		done = timings.track("migrations")
+		defer done()
+
+		if s.Settings.CreateMigrationRole {
+			err = s.withCredentialRefresh(ctx, s.createMigrationRole)
+			if err != nil {
+				return s.Runtime.StartError(err)
+			}
+		}
+
+		err = s.withCredentialRefresh(ctx, s.applyMigrations)
 		if err != nil {
 			return s.Runtime.StartError(err)
 		}
 
+		if s.Settings.GenerateGoModels {
+			err = s.withCredentialRefresh(ctx, s.generateGoModels)
+			if err != nil {
+				return s.Runtime.StartError(err)
+			}
+		}
+
+		// The dump is informational: a failure doesn't fail the start
+		if s.Settings.SchemaDumpPath != "" {
+			err = s.withCredentialRefresh(ctx, s.dumpSchema)
+			if err != nil {
+				s.Wool.Warn("cannot dump schema", wool.ErrField(err))
+			}
+		}
+
 		if s.Settings.HotReload {
-			conf := services.NewWatchConfiguration(requirements)
+			s.reload = newDebouncer(s.Settings.HotReloadDebounce)
+			conf := services.NewWatchConfiguration(s.requirements)
 			err := s.SetupWatcher(ctx, conf, s.EventHandler)
 			if err != nil {
 				s.Wool.Warn("error in watcher", wool.ErrField(err))
 			}
 		}
 	}
+
+	if s.Settings.TruncateOnStart {
+		err = s.withCredentialRefresh(ctx, s.TruncateAll)
+		if err != nil {
+			return s.Runtime.StartError(err)
+		}
+	}
+
+	if s.Settings.SeedDir != "" && (!s.Settings.NoMigration || s.Settings.RunSeeds) {
+		done = timings.track("seeds")
+		err = s.withCredentialRefresh(ctx, s.applySeeds)
+		done()
+		if err != nil {
+			return s.Runtime.StartError(err)
+		}
+	}
 	s.Wool.Debug("start done")
 	return s.Runtime.StartResponse()
 }
 
+// resetSchema drops the public schema with all the data: migrations then start from scratch
+func (s *Runtime) resetSchema(ctx context.Context) error {
+	if s.Runtime.Environment == nil || !resources.EnvironmentFromProto(s.Runtime.Environment).Local() {
+		return s.Wool.NewError("reset-schema-on-start drops all the data: refusing outside of a local environment")
+	}
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	s.Wool.Warn(fmt.Sprintf("RESETTING SCHEMA public OF %s: all its data is dropped", s.DatabaseName))
+	if _, err = db.ExecContext(ctx, "DROP SCHEMA public CASCADE; CREATE SCHEMA public;"); err != nil {
+		return s.Wool.Wrapf(err, "cannot reset schema")
+	}
+	return nil
+}
+
+// TruncateAll empties every table but the migration versions: the schema stays migrated
+func (s *Runtime) TruncateAll(ctx context.Context) error {
+	if s.Runtime.Environment == nil || !resources.EnvironmentFromProto(s.Runtime.Environment).Local() {
+		return s.Wool.NewError("truncating drops all the data: refusing outside of a local environment")
+	}
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT schemaname, tablename FROM pg_tables WHERE schemaname NOT IN ('pg_catalog', 'information_schema') AND tablename <> ALL($1)",
+		pq.Array(s.migrationConfig.VersionTables()))
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot list tables")
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var schema, table string
+		if err = rows.Scan(&schema, &table); err != nil {
+			return s.Wool.Wrapf(err, "cannot read table")
+		}
+		tables = append(tables, pq.QuoteIdentifier(schema)+"."+pq.QuoteIdentifier(table))
+	}
+	if err = rows.Err(); err != nil {
+		return s.Wool.Wrapf(err, "cannot list tables")
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	s.Wool.Warn(fmt.Sprintf("TRUNCATING %d TABLES OF %s: all their data is dropped", len(tables), s.DatabaseName))
+	if _, err = db.ExecContext(ctx, fmt.Sprintf("TRUNCATE %s RESTART IDENTITY CASCADE", strings.Join(tables, ", "))); err != nil {
+		return s.Wool.Wrapf(err, "cannot truncate tables")
+	}
+	return nil
+}
+
+// createSearchPathSchema creates the schema of the default-search-path the tables go in: safe to re-run
+func (s *Runtime) createSearchPathSchema(ctx context.Context) error {
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	schema := searchPathSchema(s.Settings.DefaultSearchPath)
+	if _, err = db.ExecContext(ctx, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", pq.QuoteIdentifier(schema))); err != nil {
+		return s.Wool.Wrapf(err, "cannot create schema %s", schema)
+	}
+	return nil
+}
+
+// createMigrationRole creates the migration role from the admin database and lets it create in the public schema
+// and the one of the default-search-path: safe to re-run
+func (s *Runtime) createMigrationRole(ctx context.Context) error {
+	if s.Settings.MigrationUser == "" {
+		return s.Wool.NewError("create-migration-role needs a migration-user")
+	}
+	admin, err := sql.Open("postgres", s.adminConnection)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot open admin database")
+	}
+	defer admin.Close()
+
+	role := pq.QuoteIdentifier(s.Settings.MigrationUser)
+	password := pq.QuoteLiteral(s.migrationPassword)
+
+	var exists bool
+	err = admin.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM pg_roles WHERE rolname = $1)", s.Settings.MigrationUser).Scan(&exists)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot check migration role")
+	}
+	statements := []string{
+		fmt.Sprintf("GRANT CONNECT, CREATE ON DATABASE %s TO %s", pq.QuoteIdentifier(s.DatabaseName), role),
+	}
+	if exists {
+		// Keep the password in sync with the configuration
+		statements = append([]string{fmt.Sprintf("ALTER ROLE %s WITH LOGIN PASSWORD %s", role, password)}, statements...)
+	} else {
+		statements = append([]string{fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD %s", role, password)}, statements...)
+	}
+	for _, statement := range statements {
+		if _, err = admin.ExecContext(ctx, statement); err != nil {
+			return s.Wool.Wrapf(err, "cannot set up migration role")
+		}
+	}
+
+	// Schemas belong to the migrated database
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	schemas := []string{"public"}
+	if s.Settings.DefaultSearchPath != "" {
+		schemas = append(schemas, searchPathSchema(s.Settings.DefaultSearchPath))
+	}
+	for _, schema := range schemas {
+		if _, err = db.ExecContext(ctx, fmt.Sprintf("GRANT CREATE, USAGE ON SCHEMA %s TO %s", pq.QuoteIdentifier(schema), role)); err != nil {
+			return s.Wool.Wrapf(err, "cannot set up migration role")
+		}
+	}
+	s.Wool.Debug("migration role ready", wool.Field("role", s.Settings.MigrationUser))
+	return nil
+}
+
+// migrationContext bounds a migration run by the apply timeout
+func (s *Runtime) migrationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Settings.ApplyTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.Settings.ApplyTimeout)
+}
+
+// applyMigrations runs one migration at a time, across replicas with the advisory lock
+func (s *Runtime) applyMigrations(ctx context.Context) error {
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+
+	ctx, cancel := s.migrationContext(ctx)
+	defer cancel()
+
+	if s.Settings.UseAdvisoryLock {
+		// Another replica may have migrated while waiting: checked under the lock
+		return s.withAdvisoryLock(ctx, s.runMigrations)
+	}
+	return s.runMigrations(ctx)
+}
+
+// runMigrations skips the migration runner when the database is already at the latest migration
+func (s *Runtime) runMigrations(ctx context.Context) error {
+	if s.Settings.SkipApplyWhenCurrent {
+		current, err := s.migrationManager.Current(ctx)
+		if err != nil {
+			return err
+		}
+		if current {
+			s.Wool.Debug("migrations are current: skipping apply")
+			return nil
+		}
+	}
+	if s.Settings.BackupBeforeMigration {
+		err := s.backupBeforeMigration(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	s.Wool.Debug("applying migrations")
+	start := time.Now()
+	result, err := s.migrationManager.Apply(ctx)
+	var version string
+	if result != nil {
+		version = result.Version
+	}
+	s.metrics.record(time.Since(start), version, err)
+	if err != nil {
+		return err
+	}
+	s.Wool.Info(fmt.Sprintf("applied %d migrations", result.Applied), wool.Field("version", result.Version))
+	return nil
+}
+
+// generateGoModels writes one Go struct per table of the migrated schema
+func (s *Runtime) generateGoModels(ctx context.Context) error {
+	output := s.Settings.GoModelsPath
+	if output == "" {
+		output = "models"
+	}
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	var ignored []string
+	if s.Settings.MigrationsTable != "" {
+		ignored = append(ignored, s.Settings.MigrationsTable)
+	}
+	return models.Generate(ctx, db, s.Local(output), ignored...)
+}
+
+// dumpSchema writes the migrated schema as JSON for drift detection across environments
+func (s *Runtime) dumpSchema(ctx context.Context) error {
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	var ignored []string
+	if s.Settings.MigrationsTable != "" {
+		ignored = append(ignored, s.Settings.MigrationsTable)
+	}
+	return models.DumpSchema(ctx, db, s.Local(s.Settings.SchemaDumpPath), ignored...)
+}
+
 func (s *Runtime) Information(ctx context.Context, req *runtimev0.InformationRequest) (*runtimev0.InformationResponse, error) {
-	return s.Runtime.InformationResponse(ctx, req)
+	resp, err := s.Runtime.InformationResponse(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.InitStatus != nil && s.containerID != "" {
+		resp.InitStatus.Message = containerSummary(resp.InitStatus.Message, s.containerName, s.containerID)
+	}
+	// A started database reports its health
+	if resp.StartStatus != nil && resp.StartStatus.State == runtimev0.StartStatus_STARTED {
+		resp.StartStatus = s.Health(ctx).startStatus()
+		if s.readiness != nil {
+			resp.StartStatus.Message += "; " + s.readiness.String()
+		}
+		if summary := s.historySummary(ctx); summary != "" {
+			resp.StartStatus.Message += "; " + summary
+		}
+	}
+	return resp, nil
+}
+
+// runPreStartCommand runs the pre-start-command in the database container, its output in the logs
+func (s *Runtime) runPreStartCommand(ctx context.Context) error {
+	command := s.Settings.PreStartCommand
+	proc, err := s.runnerEnvironment.NewProcess(command[0], command[1:]...)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot create pre-start command")
+	}
+	s.Wool.Info("running pre-start command", wool.Field("command", command))
+	err = proc.Run(ctx)
+	if err != nil {
+		return s.Wool.Wrapf(err, "pre-start command %s failed", strings.Join(command, " "))
+	}
+	return nil
+}
+
+// shortContainerID is the length of the IDs shown by docker ps
+const shortContainerID = 12
+
+// containerSummary appends the container to a status message
+func containerSummary(message string, name string, id string) string {
+	if len(id) > shortContainerID {
+		id = id[:shortContainerID]
+	}
+	summary := fmt.Sprintf("container %s (%s)", name, id)
+	if message == "" {
+		return summary
+	}
+	return message + "; " + summary
+}
+
+// MigrationHistory lists the applied migrations of the database
+func (s *Runtime) MigrationHistory(ctx context.Context) ([]migrations.MigrationRecord, error) {
+	if s.migrationManager == nil {
+		return nil, nil
+	}
+	return s.migrationManager.History(ctx)
+}
+
+// PendingMigrations lists the migration versions not applied yet, without applying them
+func (s *Runtime) PendingMigrations(ctx context.Context) ([]string, error) {
+	if s.migrationManager == nil {
+		return nil, nil
+	}
+	return s.migrationManager.Pending(ctx)
+}
+
+// historySummary fits the history and the pending migrations in a status message:
+// MigrationHistory and PendingMigrations have the full lists
+func (s *Runtime) historySummary(ctx context.Context) string {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	records, err := s.MigrationHistory(ctx)
+	if err != nil {
+		s.Wool.Debug("cannot get migration history", wool.ErrField(err))
+		return ""
+	}
+	var summary []string
+	if len(records) > 0 {
+		latest := records[len(records)-1]
+		summary = append(summary, fmt.Sprintf("%d migrations applied, latest: %s %s", len(records), latest.Version, latest.Name))
+	}
+	pending, err := s.PendingMigrations(ctx)
+	if err != nil {
+		s.Wool.Debug("cannot get pending migrations", wool.ErrField(err))
+	}
+	if len(pending) > 0 {
+		summary = append(summary, fmt.Sprintf("%d pending: %s", len(pending), strings.Join(pending, ", ")))
+	}
+	return strings.Join(summary, "; ")
 }
 
 func (s *Runtime) Stop(ctx context.Context, req *runtimev0.StopRequest) (*runtimev0.StopResponse, error) {
 	defer s.Wool.Catch()
+	ctx = s.Wool.Inject(ctx)
 
-	s.Wool.Debug("nothing to stop: keep environment alive")
+	s.stopProbeServer(ctx)
 
-	err := s.Base.Stop()
+	err := s.suspend(ctx)
+	if err != nil {
+		return s.Runtime.StopError(err)
+	}
+
+	err = s.Base.Stop()
 	if err != nil {
 		return s.Runtime.StopError(err)
 	}
 	return s.Runtime.StopResponse()
 }
 
+// suspend the container according to the stop behavior
+func (s *Runtime) suspend(ctx context.Context) error {
+	behavior := s.Settings.StopBehavior
+	if behavior == "" || behavior == KeepAliveStopBehavior {
+		s.Wool.Debug("nothing to stop: keep environment alive")
+		return nil
+	}
+	if s.runnerEnvironment == nil {
+		s.Wool.Debug("nothing to stop: environment not initialized")
+		return nil
+	}
+	switch behavior {
+	case StopStopBehavior:
+		s.Wool.Debug("stopping container")
+		err := s.runnerEnvironment.Stop(ctx)
+		if err != nil {
+			return err
+		}
+	case PauseStopBehavior:
+		s.Wool.Debug("pausing container")
+		err := s.withContainer(ctx, func(cli *client.Client, id string) error {
+			return cli.ContainerPause(ctx, id)
+		})
+		if err != nil {
+			return s.Wool.Wrapf(err, "cannot pause container")
+		}
+	default:
+		return s.Wool.NewError("unknown stop behavior: %s", behavior)
+	}
+	s.suspended = behavior
+	return nil
+}
+
+// resume the container suspended by a previous Stop
+func (s *Runtime) resume(ctx context.Context) error {
+	switch s.suspended {
+	case StopStopBehavior:
+		s.Wool.Debug("restarting container")
+		err := s.runnerEnvironment.Init(ctx)
+		if err != nil {
+			return err
+		}
+	case PauseStopBehavior:
+		s.Wool.Debug("unpausing container")
+		err := s.withContainer(ctx, func(cli *client.Client, id string) error {
+			return cli.ContainerUnpause(ctx, id)
+		})
+		if err != nil {
+			return s.Wool.Wrapf(err, "cannot unpause container")
+		}
+	}
+	s.suspended = ""
+	return nil
+}
+
+// handleExistingContainer applies the existing container policy to a container left by a previous run:
+// the runner reuses a container with the same name. With reuse-container, a container that doesn't match
+// the runtime is recreated and a matching one is adopted as it is: reused tells the image needs no pull
+func (s *Runtime) handleExistingContainer(ctx context.Context) (reused bool, err error) {
+	policy := s.Settings.ExistingContainerPolicy
+	if policy == "" {
+		policy = ReuseExistingContainerPolicy
+	}
+	switch policy {
+	case ReuseExistingContainerPolicy, RecreateExistingContainerPolicy, FailExistingContainerPolicy:
+	default:
+		return false, s.Wool.NewError("unknown existing container policy: %s", policy)
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, s.Wool.Wrapf(err, "cannot create docker client")
+	}
+	defer cli.Close()
+
+	name := runners.ContainerName(s.UniqueWithWorkspace())
+	inspect, err := cli.ContainerInspect(ctx, name)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, s.Wool.Wrapf(err, "cannot inspect container")
+	}
+
+	w := s.Wool.With(wool.Field("container", name), wool.Field("status", inspect.State.Status))
+	if policy == FailExistingContainerPolicy {
+		return false, w.NewError("container %s already exists: destroy it or change the existing container policy", name)
+	}
+	// A dead container can't be reused
+	healthy := !inspect.State.Dead && !inspect.State.OOMKilled && inspect.State.Status != "removing"
+
+	// postgres only reads POSTGRES_PASSWORD on an empty data directory: a rotated password is synced on start
+	password, rotated := containerEnv(inspect, "POSTGRES_PASSWORD")
+	rotated = rotated && s.Settings.RotatePassword && password != s.postgresPassword
+	if policy == ReuseExistingContainerPolicy && healthy && s.Settings.ReuseContainer {
+		var ignored []string
+		if rotated {
+			ignored = append(ignored, "POSTGRES_PASSWORD")
+		}
+		if mismatch := s.containerMismatch(inspect, ignored...); mismatch != "" {
+			w.Warn("existing container doesn't match: recreating it and its data", wool.Field("mismatch", mismatch))
+			healthy = false
+		}
+	}
+	if policy == ReuseExistingContainerPolicy && healthy {
+		if inspect.State.Paused {
+			if err = cli.ContainerUnpause(ctx, inspect.ID); err != nil {
+				return false, w.Wrapf(err, "cannot unpause existing container")
+			}
+		}
+		if rotated {
+			w.Info("password changed: syncing it on start")
+			s.stalePassword = password
+		}
+		w.Info("reusing existing container")
+		if s.Settings.ReuseContainer {
+			// The image of the container is present
+			s.postgresImage = resources.NewDockerImage(inspect.Config.Image)
+			return true, nil
+		}
+		return false, nil
+	}
+	w.Warn("removing existing container and its data")
+	if err = cli.ContainerRemove(ctx, inspect.ID, container.RemoveOptions{Force: true}); err != nil {
+		return false, w.Wrapf(err, "cannot remove existing container")
+	}
+	return false, nil
+}
+
+// containerEnvironment creates the database and its user
+func (s *Service) containerEnvironment() []*resources.EnvironmentVariable {
+	envs := []*resources.EnvironmentVariable{
+		resources.Env("POSTGRES_USER", s.postgresUser),
+		resources.Env("POSTGRES_PASSWORD", s.postgresPassword),
+		resources.Env("POSTGRES_DB", s.DatabaseName),
+	}
+	if s.Settings.HostAuthMethod != "" {
+		envs = append(envs, resources.Env("POSTGRES_HOST_AUTH_METHOD", s.Settings.HostAuthMethod))
+	}
+	return envs
+}
+
+// containerEnv is the value of an environment variable of the container
+func containerEnv(inspect types.ContainerJSON, key string) (string, bool) {
+	if inspect.Config == nil {
+		return "", false
+	}
+	for _, v := range inspect.Config.Env {
+		if k, value, ok := strings.Cut(v, "="); ok && k == key {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// containerMismatch tells why an existing container can't serve the runtime, without checking the ignored variables: empty when it can
+func (s *Runtime) containerMismatch(inspect types.ContainerJSON, ignored ...string) string {
+	if inspect.Config == nil || inspect.HostConfig == nil {
+		return "no configuration"
+	}
+	if inspect.Config.Image != s.image().FullName() {
+		return fmt.Sprintf("image %s", inspect.Config.Image)
+	}
+	// The password is a secret: only the names are reported
+	env := make(map[string]bool)
+	for _, v := range inspect.Config.Env {
+		env[v] = true
+	}
+	for _, expected := range s.containerEnvironment() {
+		if !env[expected.String()] && !slices.Contains(ignored, expected.Key) {
+			return fmt.Sprintf("environment variable %s", expected.Key)
+		}
+	}
+	port := nat.Port(fmt.Sprintf("%d/tcp", s.postgresPort))
+	for _, binding := range inspect.HostConfig.PortBindings[port] {
+		if binding.HostPort == fmt.Sprintf("%d", s.hostPort) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("port mapping of %s", port)
+}
+
+// existingEnvironment finds the container of the service by name like Init does: nil when there is none
+func (s *Runtime) existingEnvironment(ctx context.Context) (*runners.DockerEnvironment, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, s.Wool.Wrapf(err, "cannot create docker client")
+	}
+	defer cli.Close()
+
+	inspect, err := cli.ContainerInspect(ctx, runners.ContainerName(s.UniqueWithWorkspace()))
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, s.Wool.Wrapf(err, "cannot inspect container")
+	}
+	if inspect.Config == nil {
+		return nil, s.Wool.NewError("container %s has no configuration", inspect.Name)
+	}
+	// The image of the container is present: nothing is pulled
+	return runners.NewDockerHeadlessEnvironment(ctx, resources.NewDockerImage(inspect.Config.Image), s.UniqueWithWorkspace())
+}
+
+// containerNotFound is true when docker reports a missing container, through the wrapping of the runners
+func containerNotFound(err error) bool {
+	var notFound errdefs.ErrNotFound
+	return errors.As(err, &notFound)
+}
+
+// withContainer calls the docker API on the postgres container: the runner environment doesn't expose pause
+func (s *Runtime) withContainer(ctx context.Context, f func(cli *client.Client, id string) error) error {
+	id, err := s.runnerEnvironment.ContainerID()
+	if err != nil {
+		return err
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot create docker client")
+	}
+	defer cli.Close()
+	return f(cli, id)
+}
+
 func (s *Runtime) Destroy(ctx context.Context, req *runtimev0.DestroyRequest) (*runtimev0.DestroyResponse, error) {
 	defer s.Wool.Catch()
 	ctx = s.Wool.Inject(ctx)
 
 	s.Wool.Debug("Destroying")
 
-	// Get the runner environment
-	runner, err := runners.NewDockerHeadlessEnvironment(ctx, image, s.UniqueWithWorkspace())
-	if err != nil {
-		return s.Runtime.DestroyError(err)
+	// Without Init, the container is the one an earlier run of the agent left behind, if any
+	if s.runnerEnvironment == nil {
+		if s.Identity == nil || s.Base.Environment == nil {
+			s.Wool.Warn("nothing to destroy: the runtime was not loaded")
+			return s.Runtime.DestroyResponse()
+		}
+		runner, err := s.existingEnvironment(ctx)
+		if err != nil {
+			return s.Runtime.DestroyError(err)
+		}
+		if runner == nil {
+			s.Wool.Warn("nothing to destroy: no container")
+			return s.Runtime.DestroyResponse()
+		}
+		s.runnerEnvironment = runner
+	}
+
+	if s.reload != nil {
+		s.reload.stop()
+	}
+
+	s.stopProbeServer(ctx)
+
+	// A migration runner still alive would hold connections to the database
+	for _, name := range migrations.RunnerContainers(s.UniqueWithWorkspace()) {
+		if err := oneshot.Remove(ctx, name); err != nil {
+			s.Wool.Warn("cannot remove migration runner", wool.ErrField(err))
+		}
 	}
 
-	err = runner.Shutdown(ctx)
+	if s.Settings.EnablePgBouncer {
+		if err := s.stopPgBouncer(ctx); err != nil {
+			s.Wool.Warn("cannot stop pgbouncer", wool.ErrField(err))
+		}
+	}
+
+	// Close waits for the queries in flight
+	if s.db != nil {
+		err := s.db.Close()
+		if err != nil {
+			s.Wool.Warn("cannot close database", wool.ErrField(err))
+		}
+		s.db = nil
+	}
+
+	err := s.runnerEnvironment.Shutdown(ctx)
+	if containerNotFound(err) {
+		// Removed behind our back: there is nothing left to shut down
+		s.Wool.Warn("postgres container already removed", wool.ErrField(err))
+		err = nil
+	}
 	if err != nil {
 		return s.Runtime.DestroyError(err)
 	}
+	s.runnerEnvironment = nil
+	s.containerID = ""
 	return s.Runtime.DestroyResponse()
 }
 
+// testCheckTimeout bounds the checks of the test phase
+const testCheckTimeout = 5 * time.Second
+
+// checkDatabase is the test of the service: the database answers and is at the migrations on disk
+func (s *Runtime) checkDatabase(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, testCheckTimeout)
+	defer cancel()
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "SELECT 1")
+	if err != nil {
+		return s.Wool.Wrapf(err, "database doesn't answer")
+	}
+	if s.Settings.NoMigration || s.migrationManager == nil {
+		return nil
+	}
+	current, err := s.migrationManager.Current(ctx)
+	if err != nil {
+		return s.Wool.Wrapf(err, "cannot check migration version")
+	}
+	if current {
+		return nil
+	}
+	pending, err := s.migrationManager.Pending(ctx)
+	if err != nil {
+		s.Wool.Debug("cannot get pending migrations", wool.ErrField(err))
+	}
+	if len(pending) > 0 {
+		return s.Wool.NewError("database is not at the latest migration: %d pending: %s", len(pending), strings.Join(pending, ", "))
+	}
+	return s.Wool.NewError("database is not at the latest migration: the migration state doesn't match the files")
+}
+
+// VerifyIdempotent replays the migrations on a shadow database when the migration format supports it
+func (s *Runtime) VerifyIdempotent(ctx context.Context) error {
+	verifier, ok := s.migrationManager.(migrations.IdempotencyVerifier)
+	if !ok {
+		return s.Wool.NewError("migration manager cannot verify idempotency")
+	}
+	return verifier.VerifyIdempotent(ctx)
+}
+
 func (s *Runtime) Test(ctx context.Context, req *runtimev0.TestRequest) (*runtimev0.TestResponse, error) {
+	defer s.Wool.Catch()
+	ctx = s.Wool.Inject(ctx)
+
+	err := s.checkDatabase(ctx)
+	if err != nil {
+		return s.Runtime.TestErrorf(err, "database check failed")
+	}
+
+	if s.Settings.VerifyIdempotent && !s.Settings.NoMigration {
+		s.Wool.Debug("verifying migrations are idempotent")
+		err := s.VerifyIdempotent(ctx)
+		if err != nil {
+			return s.Runtime.TestErrorf(err, "cannot verify migration idempotency")
+		}
+	}
 	return s.Runtime.TestResponse()
 }
 
@@ -276,10 +1505,19 @@ func (s *Runtime) Communicate(ctx context.Context, req *agentv0.Engage) (*agentv
  */
 
 func (s *Runtime) EventHandler(event code.Change) error {
-	if strings.Contains(event.Path, "migrations") {
-		err := s.updateMigration(context.Background(), event.Path)
-		if err != nil {
-			s.Wool.Warn("cannot apply migration", wool.ErrField(err))
+	// The watcher may report a change before Init is done or after it failed
+	if s.migrationManager == nil || s.reload == nil {
+		s.Wool.Debug("ignoring change: migrations not initialized", wool.FileField(event.Path))
+		return nil
+	}
+	for _, dir := range s.migrationDirs() {
+		if strings.Contains(event.Path, dir) {
+			if !s.migrationManager.Accepts(event.Path) {
+				s.Wool.Warn("ignoring migration file with an unexpected name", wool.FileField(event.Path))
+				return nil
+			}
+			s.reload.trigger(event.Path, s.reloadMigrations)
+			return nil
 		}
 	}
 	return nil
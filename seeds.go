@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codefly-dev/core/shared"
+	"github.com/codefly-dev/core/wool"
+)
+
+// seedFiles are the .sql files of the directory in lexical order
+func seedFiles(ctx context.Context, dir string) ([]string, error) {
+	w := wool.Get(ctx).In("seedFiles", wool.DirField(dir))
+	exists, err := shared.DirectoryExists(ctx, dir)
+	if err != nil {
+		return nil, w.Wrapf(err, "cannot check seed directory")
+	}
+	if !exists {
+		return nil, w.NewError("seed directory doesn't exist: %s", dir)
+	}
+	// ReadDir sorts by name
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, w.Wrapf(err, "cannot read seed directory")
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	return files, nil
+}
+
+// applySeeds runs every seed file after the migrations: seeds are not versioned and run on every start
+func (s *Runtime) applySeeds(ctx context.Context) error {
+	files, err := seedFiles(ctx, s.Local(s.Settings.SeedDir))
+	if err != nil {
+		return err
+	}
+	db, err := s.database()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = s.applySeed(ctx, db, file); err != nil {
+			return err
+		}
+	}
+	s.Wool.Debug("seeds applied", wool.Field("count", len(files)))
+	return nil
+}
+
+// applySeed runs a seed file in its own transaction: a failing file leaves no partial data
+func (s *Runtime) applySeed(ctx context.Context, db *sql.DB, file string) error {
+	w := s.Wool.With(wool.FileField(file))
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return w.Wrapf(err, "cannot read seed")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return w.Wrapf(err, "cannot begin seed transaction")
+	}
+	if _, err = tx.ExecContext(ctx, string(content)); err != nil {
+		_ = tx.Rollback()
+		return w.Wrapf(err, "cannot apply seed %s", filepath.Base(file))
+	}
+	if err = tx.Commit(); err != nil {
+		return w.Wrapf(err, "cannot commit seed %s", filepath.Base(file))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/codefly-dev/core/resources"
+	"github.com/codefly-dev/core/wool"
+	"github.com/codefly-dev/service-external-postgres/migrations"
+)
+
+// searchPath is a list of unquoted schemas: the options parameter is split on spaces
+var searchPath = regexp.MustCompile(`^[a-z_][a-z0-9_]*(,[a-z_][a-z0-9_]*)*$`)
+
+// searchPathSchema is the schema unqualified tables are created in
+func searchPathSchema(searchPath string) string {
+	schema, _, _ := strings.Cut(searchPath, ",")
+	return schema
+}
+
+// oneOf reports a value outside of the allowed ones, the empty default included
+func oneOf(problems []string, key string, value string, allowed ...string) []string {
+	if value == "" {
+		return problems
+	}
+	for _, a := range allowed {
+		if value == a {
+			return problems
+		}
+	}
+	return append(problems, key+" must be one of "+strings.Join(allowed, ", ")+": got "+value)
+}
+
+// Validate checks the settings together so a service.codefly.yaml with several mistakes is fixed in one pass
+func (s *Settings) Validate() error {
+	var problems []string
+	if err := validateDatabaseName(s.DatabaseName); err != nil {
+		problems = append(problems, err.Error())
+	}
+	problems = oneOf(problems, "migration-format", s.MigrationFormat,
+		migrations.GolangMigrateFormat, migrations.DbmateFormat, migrations.FlywayFormat, migrations.AutoFormat)
+	problems = oneOf(problems, "pooling-mode", s.PoolingMode,
+		SessionPoolingMode, TransactionPoolingMode, StatementPoolingMode)
+	problems = oneOf(problems, "connection-format", s.ConnectionFormat,
+		URLConnectionFormat, KeywordConnectionFormat)
+	problems = oneOf(problems, "stop-behavior", s.StopBehavior,
+		KeepAliveStopBehavior, StopStopBehavior, PauseStopBehavior)
+	problems = oneOf(problems, "existing-container-policy", s.ExistingContainerPolicy,
+		ReuseExistingContainerPolicy, RecreateExistingContainerPolicy, FailExistingContainerPolicy)
+	problems = oneOf(problems, "host-auth-method", s.HostAuthMethod,
+		TrustHostAuthMethod, ScramSHA256HostAuthMethod, MD5HostAuthMethod)
+	problems = oneOf(problems, "deploy-mode", s.DeployMode,
+		ExternalDeployMode, ManagedDeployMode)
+	if _, err := parseMemory(s.ContainerMemoryLimit); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseCPU(s.ContainerCPULimit); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseMemory(s.StorageSize); err != nil {
+		problems = append(problems, "storage-size: "+err.Error())
+	}
+	if err := validateRoles(s.Roles); err != nil {
+		problems = append(problems, err.Error())
+	}
+	var keys []string
+	for key := range s.ServerParameters {
+		if !serverParameterName.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		problems = append(problems, "invalid server parameter name: "+key)
+	}
+	if s.DefaultSearchPath != "" {
+		if !searchPath.MatchString(s.DefaultSearchPath) {
+			problems = append(problems, "invalid default-search-path "+s.DefaultSearchPath+": use comma-separated lowercase schema names")
+		} else if s.Schema != "" && s.Schema != searchPathSchema(s.DefaultSearchPath) {
+			problems = append(problems, "schema and default-search-path must create the tables in the same schema")
+		}
+	}
+	if s.PostgresConfPath != "" && len(s.ServerParameters) > 0 {
+		problems = append(problems, "postgres-conf-path and server-parameters both configure the server")
+	}
+	if s.MigrateToVersion != "" && s.MigrationFormat == migrations.DbmateFormat {
+		problems = append(problems, "migrate-to-version is not supported by dbmate")
+	}
+	if len(s.MigrationDirs) > 0 {
+		if s.MigrateToVersion != "" {
+			problems = append(problems, "migrate-to-version needs a single migration directory: unset migration-dirs")
+		}
+		if len(s.MigrationDirByEnvironment) > 0 {
+			problems = append(problems, "migration-dirs and migration-dir-by-environment both set the migration directory")
+		}
+		if slices.Contains(s.MigrationDirs, "") {
+			problems = append(problems, "migration-dirs cannot have an empty directory")
+		}
+	}
+	if s.ReuseContainer && s.ExistingContainerPolicy != "" && s.ExistingContainerPolicy != ReuseExistingContainerPolicy {
+		problems = append(problems, "reuse-container needs the reuse existing-container-policy")
+	}
+	if s.FallbackImage != "" && resources.NewDockerImage(s.FallbackImage) == nil {
+		problems = append(problems, "invalid fallback-image: "+s.FallbackImage)
+	}
+	if len(s.PreStartCommand) > 0 && s.PreStartCommand[0] == "" {
+		problems = append(problems, "pre-start-command must start with an executable")
+	}
+	if s.PgBouncerPoolSize < 0 {
+		problems = append(problems, "pgbouncer-pool-size must be positive")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return wool.Get(context.Background()).In("Settings.Validate").NewError(
+		"invalid settings:\n- %s", strings.Join(problems, "\n- "))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codefly-dev/core/wool"
+)
+
+// phaseTimings records how long each phase of a lifecycle step takes
+type phaseTimings struct {
+	step   string
+	start  time.Time
+	end    time.Time
+	phases []phaseTiming
+}
+
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+func newPhaseTimings(step string) *phaseTimings {
+	return &phaseTimings{step: step, start: time.Now()}
+}
+
+// track starts a phase: call the returned function once it is done
+func (p *phaseTimings) track(name string) func() {
+	start := time.Now()
+	return func() {
+		p.phases = append(p.phases, phaseTiming{name: name, duration: time.Since(start)})
+	}
+}
+
+// duration of a phase: 0 if it didn't run
+func (p *phaseTimings) duration(name string) time.Duration {
+	for _, phase := range p.phases {
+		if phase.name == name {
+			return phase.duration
+		}
+	}
+	return 0
+}
+
+// total of the step: up to now while it runs
+func (p *phaseTimings) total() time.Duration {
+	if p.end.IsZero() {
+		return time.Since(p.start)
+	}
+	return p.end.Sub(p.start)
+}
+
+// log ends the step and logs the phases and the total as structured fields
+func (p *phaseTimings) log(w *wool.Wool) {
+	p.end = time.Now()
+	fields := make([]*wool.LogField, 0, len(p.phases)+1)
+	for _, phase := range p.phases {
+		fields = append(fields, wool.Field(phase.name, phase.duration.String()))
+	}
+	fields = append(fields, wool.Field("total", p.total().String()))
+	w.Info(fmt.Sprintf("%s timings", p.step), fields...)
+}
+
+// readiness records how long the database took to accept queries
+type readiness struct {
+	duration time.Duration
+	retries  int
+}
+
+// immediate when the database was ready at the first attempt
+func (r *readiness) immediate() bool {
+	return r.retries == 0
+}
+
+func (r *readiness) String() string {
+	if r.immediate() {
+		return fmt.Sprintf("readiness_duration_ms=%d (ready immediately)", r.duration.Milliseconds())
+	}
+	return fmt.Sprintf("readiness_duration_ms=%d (after %d retries)", r.duration.Milliseconds(), r.retries)
+}